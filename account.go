@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const emailVerificationTokenTTL = 48 * time.Hour
+const passwordResetTokenTTL = time.Hour
+
+func sendVerificationEmail(c *fiber.Ctx, user *User) error {
+	tokenManager, ok := c.Locals("tokens").(*TokenManager)
+	if !ok {
+		log.Fatal("error getting `tokens` from c.Locals()")
+	}
+
+	mailer, ok := c.Locals("mailer").(Mailer)
+	if !ok {
+		log.Fatal("error getting `mailer` from c.Locals()")
+	}
+
+	appURL, ok := c.Locals("appURL").(string)
+	if !ok {
+		log.Fatal("error getting `appURL` from c.Locals()")
+	}
+
+	token, err := tokenManager.IssueOneTimeToken(c.Context(), OneTimeTokenEmailVerification, user.ID, emailVerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/ui/verify-email?token=%s", appURL, token)
+	err = mailer.Send(c.Context(), Mail{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body:    fmt.Sprintf("Hi %s,\n\nplease verify your email by opening %s\n\nThe link expires in %s.\n", user.Name, link, emailVerificationTokenTTL),
+	})
+	if err != nil {
+		return errors.Wrap(err, "send verification email")
+	}
+
+	return nil
+}
+
+// sendPasswordResetEmail sends password reset link if user with email exists
+// and does nothing otherwise, so that response does not reveal registered
+// emails
+func sendPasswordResetEmail(c *fiber.Ctx, db *gorm.DB, email string) error {
+	tokenManager, ok := c.Locals("tokens").(*TokenManager)
+	if !ok {
+		log.Fatal("error getting `tokens` from c.Locals()")
+	}
+
+	mailer, ok := c.Locals("mailer").(Mailer)
+	if !ok {
+		log.Fatal("error getting `mailer` from c.Locals()")
+	}
+
+	appURL, ok := c.Locals("appURL").(string)
+	if !ok {
+		log.Fatal("error getting `appURL` from c.Locals()")
+	}
+
+	var user User
+	tx := db.Where("lower(email) = ?", normalizeEmail(email)).Limit(1).Find(&user)
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "Get user by email")
+	}
+	if tx.RowsAffected == 0 {
+		return nil
+	}
+
+	token, err := tokenManager.IssueOneTimeToken(c.Context(), OneTimeTokenPasswordReset, user.ID, passwordResetTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/ui/reset-password?token=%s", appURL, token)
+	err = mailer.Send(c.Context(), Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body:    fmt.Sprintf("Hi %s,\n\nyou can set a new password by opening %s\n\nThe link expires in %s. If you did not request it, ignore this email.\n", user.Name, link, passwordResetTokenTTL),
+	})
+	if err != nil {
+		return errors.Wrap(err, "send password reset email")
+	}
+
+	return nil
+}
+
+func verifyEmail(c *fiber.Ctx, db *gorm.DB, token string) error {
+	tokenManager, ok := c.Locals("tokens").(*TokenManager)
+	if !ok {
+		log.Fatal("error getting `tokens` from c.Locals()")
+	}
+
+	userID, err := tokenManager.ConsumeOneTimeToken(c.Context(), OneTimeTokenEmailVerification, token)
+	if err != nil {
+		return err
+	}
+
+	err = db.Model(&User{}).Where("id = ?", userID).Update("EmailVerifiedAt", time.Now()).Error
+	if err != nil {
+		return errors.Wrap(err, "Update user email verified at")
+	}
+
+	return nil
+}
+
+type ResetPasswordRequestSchema struct {
+	Token    string `validate:"required"`
+	Password string `validate:"required,password"`
+}
+
+// resetPassword sets new password of user and revokes every session of the
+// user, as the old password may be known to someone else
+func resetPassword(c *fiber.Ctx, db *gorm.DB, data ResetPasswordRequestSchema) error {
+	tokenManager, ok := c.Locals("tokens").(*TokenManager)
+	if !ok {
+		log.Fatal("error getting `tokens` from c.Locals()")
+	}
+
+	registry, ok := c.Locals("sessions").(*SessionRegistry)
+	if !ok {
+		log.Fatal("error getting `sessions` from c.Locals()")
+	}
+
+	userID, err := tokenManager.ConsumeOneTimeToken(c.Context(), OneTimeTokenPasswordReset, data.Token)
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := hashPassword(data.Password)
+	if err != nil {
+		return err
+	}
+
+	err = db.Model(&User{}).Where("id = ?", userID).Update("PasswordHash", passwordHash).Error
+	if err != nil {
+		return errors.Wrap(err, "Update user password hash")
+	}
+
+	sessions, err := registry.List(c.Context(), userID)
+	if err != nil {
+		return err
+	}
+	for _, sessionInfo := range sessions {
+		err = registry.Revoke(c.Context(), userID, sessionInfo.ID)
+		if err != nil && !errors.Is(err, fiber.ErrNotFound) {
+			return err
+		}
+	}
+
+	return tokenManager.RevokeUserTokens(c.Context(), userID)
+}
@@ -52,7 +52,7 @@ func main() {
 
 	redisDB := getRedis(config)
 
-	app := createApp(postgresDB, redisDB)
+	app, _ := createApp(config, postgresDB, redisDB, getMailer(config))
 
 	appUrl := getAppURL(config)
 	log.Fatal(app.Listen(appUrl))
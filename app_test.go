@@ -71,8 +71,7 @@ func TestSendMessage(t *testing.T) {
 
 	messageContent := "hello"
 	data := SendMessageRequest{
-		UserEmail: user.Email,
-		Content:   messageContent,
+		Content: messageContent,
 	}
 	marshalled, err := json.Marshal(data)
 	utils.AssertEqual(t, nil, err)
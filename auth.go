@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// normalizeEmail returns email as it is stored, emails are compared case
+// insensitively
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// authenticateUser returns user with given email if password matches it, or
+// `InvalidCredentialsError` otherwise
+func authenticateUser(db *gorm.DB, email, password string) (*User, error) {
+	var user User
+	tx := db.Where("lower(email) = ?", normalizeEmail(email)).First(&user)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		verifyPassword("", password)
+		return nil, &InvalidCredentialsError{}
+	} else if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "Get user by email")
+	}
+
+	if !verifyPassword(user.PasswordHash, password) {
+		return nil, &InvalidCredentialsError{}
+	}
+
+	if passwordNeedsRehash(user.PasswordHash) {
+		passwordHash, err := hashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.Model(&user).Update("PasswordHash", passwordHash).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "Update user password hash")
+		}
+	}
+
+	return &user, nil
+}
+
+type SignupRequestSchema struct {
+	Name     string `validate:"required"`
+	Email    string `validate:"required,email"`
+	Password string `validate:"required,password"`
+}
+
+// signupUser validates signup data and creates a user. Validation problems
+// are returned as a list of `FieldError`, with nil user and error
+func signupUser(db *gorm.DB, validate *validator.Validate, data SignupRequestSchema) (*User, []FieldError, error) {
+	data.Email = normalizeEmail(data.Email)
+
+	err := validate.Struct(data)
+	if err != nil {
+		var validationErrors validator.ValidationErrors
+		if errors.As(err, &validationErrors) {
+			return nil, getFieldErrors(validationErrors), nil
+		}
+		return nil, nil, err
+	}
+
+	user := User{
+		Name:     data.Name,
+		Email:    data.Email,
+		Password: data.Password,
+	}
+	// unique index on email decides whether it is taken, so concurrent
+	// signups can not create two users with the same email
+	tx := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&user)
+	if tx.Error != nil {
+		return nil, nil, errors.Wrap(tx.Error, "Create user")
+	}
+	if tx.RowsAffected == 0 {
+		return nil, []FieldError{{Field: "Email", Tag: "unique"}}, nil
+	}
+	user.Password = ""
+
+	return &user, nil, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const brokerChannel = "chat_events"
+
+// ChatEvent is websocket event of chat for its members. Message is sent to
+// connections subscribed to the chat, Notification to other connections of
+// the members and may be empty. MessageID is set for events of new messages,
+// so they are not sent twice to connections that replay missed messages.
+// Connection with SkipClientID does not get the event, as it caused it.
+// Event with CloseSessionID closes connections of the revoked session instead
+type ChatEvent struct {
+	ChatID         uint
+	MessageID      uint `json:",omitempty"`
+	UserIDs        []uint
+	Message        json.RawMessage
+	Notification   json.RawMessage `json:",omitempty"`
+	SkipClientID   string          `json:",omitempty"`
+	CloseSessionID string          `json:",omitempty"`
+}
+
+// Broker delivers chat events to every instance of the app, so that each of
+// them sends events to its own websocket connections
+type Broker interface {
+	Publish(ctx context.Context, event ChatEvent) error
+	// Subscribe calls handler for every event published by any instance until
+	// ctx is done
+	Subscribe(ctx context.Context, handler func(ChatEvent)) error
+}
+
+type RedisBroker struct {
+	redis goredis.UniversalClient
+}
+
+func NewRedisBroker(redisClient goredis.UniversalClient) *RedisBroker {
+	return &RedisBroker{
+		redis: redisClient,
+	}
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, event ChatEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "json marshall ChatEvent")
+	}
+
+	err = b.redis.Publish(ctx, brokerChannel, data).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis publish chat event")
+	}
+	return nil
+}
+
+func (b *RedisBroker) Subscribe(ctx context.Context, handler func(ChatEvent)) error {
+	pubsub := b.redis.Subscribe(ctx, brokerChannel)
+
+	// wait for confirmation, so that events published after Subscribe returns
+	// are not missed
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return errors.Wrap(err, "redis subscribe to chat events")
+	}
+
+	go func() {
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				var event ChatEvent
+				err := json.Unmarshal([]byte(message.Payload), &event)
+				if err != nil {
+					log.Errorf("json unmarshall ChatEvent err=%s\n", err)
+					continue
+				}
+				handler(event)
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// InMemoryBroker delivers events within the process only. It is used in
+// tests and when the app runs as a single instance
+type InMemoryBroker struct {
+	mu       sync.RWMutex
+	handlers map[int]func(ChatEvent)
+	nextID   int
+}
+
+func NewInMemoryBroker() *InMemoryBroker {
+	return &InMemoryBroker{
+		handlers: map[int]func(ChatEvent){},
+	}
+}
+
+func (b *InMemoryBroker) Publish(ctx context.Context, event ChatEvent) error {
+	b.mu.RLock()
+	handlers := make([]func(ChatEvent), 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (b *InMemoryBroker) Subscribe(ctx context.Context, handler func(ChatEvent)) error {
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID += 1
+	b.handlers[id] = handler
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		delete(b.handlers, id)
+		b.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// getBroker returns in-memory broker when `BROKER` is `memory` and Redis
+// broker otherwise
+func getBroker(config *Config, redisClient goredis.UniversalClient) Broker {
+	if config.GetString("BROKER") == "memory" {
+		return NewInMemoryBroker()
+	}
+
+	return NewRedisBroker(redisClient)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// testBroker checks that every subscriber gets published event and that
+// subscription ends with its context
+func testBroker(t *testing.T, broker Broker) {
+	t.Helper()
+
+	event := ChatEvent{
+		ChatID:  1,
+		UserIDs: []uint{2, 3},
+		Message: json.RawMessage(`{"Type":"new_message"}`),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan ChatEvent, 2)
+	for i := 0; i < 2; i += 1 {
+		err := broker.Subscribe(ctx, func(event ChatEvent) {
+			received <- event
+		})
+		utils.AssertEqual(t, nil, err)
+	}
+
+	err := broker.Publish(context.Background(), event)
+	utils.AssertEqual(t, nil, err)
+
+	for i := 0; i < 2; i += 1 {
+		select {
+		case got := <-received:
+			utils.AssertEqual(t, event.ChatID, got.ChatID)
+			utils.AssertEqual(t, event.UserIDs, got.UserIDs)
+			utils.AssertEqual(t, string(event.Message), string(got.Message))
+		case <-time.After(5 * time.Second):
+			t.Fatal("event was not delivered")
+		}
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	err = broker.Publish(context.Background(), event)
+	utils.AssertEqual(t, nil, err)
+
+	select {
+	case <-received:
+		t.Fatal("event was delivered after unsubscribe")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInMemoryBroker(t *testing.T) {
+	t.Parallel()
+
+	testBroker(t, NewInMemoryBroker())
+}
+
+func TestRedisBroker(t *testing.T) {
+	redisDB := getRedis(NewConfig("test_config"))
+	defer redisDB.Close()
+
+	testBroker(t, NewRedisBroker(redisDB.Conn()))
+}
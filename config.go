@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log/slog"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -39,3 +40,21 @@ func NewConfig(configName string) *Config {
 
 	return config
 }
+
+func getJWTSecret(config *Config) []byte {
+	secret := config.GetString("JWT_SECRET")
+	if secret == "" {
+		panic(fmt.Errorf("JWT_SECRET is not set for config %s", config.ConfigFileUsed()))
+	}
+	return []byte(secret)
+}
+
+// getPublicURL returns public URL of the app that links in emails point to. It
+// is configured, as Host header of request is set by client
+func getPublicURL(config *Config) string {
+	appURL := strings.TrimSuffix(config.GetString("APP_URL"), "/")
+	if appURL == "" {
+		panic(fmt.Errorf("APP_URL is not set for config %s", config.ConfigFileUsed()))
+	}
+	return appURL
+}
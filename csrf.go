@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/pkg/errors"
+)
+
+var CSRFTokenKey = "CSRFToken"
+
+const CSRFTokenFormField = "csrf_token"
+const CSRFTokenHeader = "X-CSRF-Token"
+
+// CSRFMiddleware protects cookie-authenticated UI forms. Token is kept in the
+// session and passed to templates as `.CSRFToken`, state-changing requests
+// must send it back in `csrf_token` form field or `X-CSRF-Token` header
+func CSRFMiddleware(c *fiber.Ctx) error {
+	token, err := checkCSRFToken(c)
+	if err != nil {
+		return err
+	}
+
+	c.Locals(CSRFTokenKey, token)
+	return c.Next()
+}
+
+// APICSRFMiddleware protects API requests authenticated by session cookie, as
+// browsers send the cookie with cross-site requests too. The token is the
+// same as of UI, safe requests get it in `X-CSRF-Token` response header.
+// Requests authenticated by bearer token are not checked, as browsers do not
+// add it by themselves. Must be used after `RequireAPIAuthMiddleware`
+func APICSRFMiddleware(c *fiber.Ctx) error {
+	if getBearerToken(c) != "" {
+		return c.Next()
+	}
+
+	token, err := checkCSRFToken(c)
+	if err != nil {
+		return err
+	}
+
+	c.Set(CSRFTokenHeader, token)
+	return c.Next()
+}
+
+// checkCSRFToken returns CSRF token of session, creating it on safe requests.
+// Other requests must send the token back
+func checkCSRFToken(c *fiber.Ctx) (string, error) {
+	store, ok := c.Locals("store").(*session.Store)
+	if !ok {
+		log.Fatal("error getting `store` from c.Locals()")
+	}
+
+	session, err := store.Get(c)
+	if err != nil {
+		return "", errors.Wrap(err, "store get")
+	}
+
+	token, _ := session.Get(CSRFTokenKey).(string)
+
+	if isSafeMethod(c.Method()) {
+		if token == "" {
+			token, err = generateRandomToken()
+			if err != nil {
+				return "", err
+			}
+
+			session.Set(CSRFTokenKey, token)
+			err = session.Save()
+			if err != nil {
+				return "", errors.Wrap(err, "session save()")
+			}
+		}
+
+		return token, nil
+	}
+
+	requestToken := c.FormValue(CSRFTokenFormField)
+	if requestToken == "" {
+		requestToken = c.Get(CSRFTokenHeader)
+	}
+
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(requestToken)) != 1 {
+		return "", fiber.NewError(fiber.StatusForbidden, "CSRF token is missing or invalid")
+	}
+
+	return token, nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions, fiber.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
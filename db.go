@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/gofiber/storage/redis/v3"
+	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
@@ -25,8 +26,22 @@ func getPostgres(config *Config) *gorm.DB {
 	slog.Debug("connect postgres", "url", dsn, "config", config.ConfigFileUsed())
 	postgresDB := connectDatabase(dsn)
 
+	err := postgresDB.SetupJoinTable(&Chat{}, "Members", &ChatMember{})
+	if err != nil {
+		panic(err)
+	}
+	err = postgresDB.SetupJoinTable(&User{}, "Chats", &ChatMember{})
+	if err != nil {
+		panic(err)
+	}
+
 	// TODO: get a list of tables from somewhere
-	err := postgresDB.AutoMigrate(&User{}, &Chat{}, &Message{})
+	err = postgresDB.AutoMigrate(&User{}, &Chat{}, &Message{}, &MessageRevision{}, &RecoveryCode{})
+	if err != nil {
+		panic(err)
+	}
+
+	err = migratePlaintextPasswords(postgresDB)
 	if err != nil {
 		panic(err)
 	}
@@ -34,6 +49,46 @@ func getPostgres(config *Config) *gorm.DB {
 	return postgresDB
 }
 
+// migratePlaintextPasswords hashes passwords of users created before passwords
+// were hashed and drops the plaintext `password` column
+func migratePlaintextPasswords(db *gorm.DB) error {
+	if !db.Migrator().HasColumn("users", "password") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var rows []struct {
+			ID       uint
+			Password string
+		}
+		err := tx.Table("users").
+			Select("id", "password").
+			Where("password <> '' AND (password_hash IS NULL OR password_hash = '')").
+			Find(&rows).Error
+		if err != nil {
+			return errors.Wrap(err, "Get plaintext passwords")
+		}
+
+		for _, row := range rows {
+			passwordHash, err := hashPassword(row.Password)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Table("users").Where("id = ?", row.ID).Update("password_hash", passwordHash).Error
+			if err != nil {
+				return errors.Wrap(err, "Update password hash")
+			}
+		}
+
+		err = tx.Migrator().DropColumn("users", "password")
+		if err != nil {
+			return errors.Wrap(err, "Drop password column")
+		}
+		return nil
+	})
+}
+
 func getRedis(config *Config) *redis.Storage {
 	var redisURL string
 
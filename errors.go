@@ -1,7 +1,55 @@
 package main
 
+import (
+	"fmt"
+	"time"
+)
+
 type UnauthorizedUserError struct{}
 
 func (e *UnauthorizedUserError) Error() string {
 	return "user is unauthorized"
 }
+
+type InvalidCredentialsError struct{}
+
+func (e *InvalidCredentialsError) Error() string {
+	return "invalid credentials"
+}
+
+type ForbiddenError struct{}
+
+func (e *ForbiddenError) Error() string {
+	return "forbidden"
+}
+
+type InvalidTokenError struct{}
+
+func (e *InvalidTokenError) Error() string {
+	return "token is invalid or expired"
+}
+
+type InvalidTwoFactorCodeError struct{}
+
+func (e *InvalidTwoFactorCodeError) Error() string {
+	return "two-factor code is invalid"
+}
+
+type TooManyLoginAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyLoginAttemptsError) Error() string {
+	return fmt.Sprintf("too many login attempts, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// WebsocketError is caused by frame client has sent, it is sent back to the
+// client in `error` frame as is
+type WebsocketError struct {
+	Code    string
+	Message string
+}
+
+func (e *WebsocketError) Error() string {
+	return e.Message
+}
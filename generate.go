@@ -75,8 +75,9 @@ func addRandomUsers(db *gorm.DB, n int) ([]User, error) {
 	users := make([]User, n)
 	for i := 0; i < n; i += 1 {
 		users[i] = User{
-			Name:  gofakeit.Name(),
-			Email: gofakeit.Email(),
+			Name:     gofakeit.Name(),
+			Email:    gofakeit.Email(),
+			Password: gofakeit.Password(true, true, true, true, true, 20),
 		}
 	}
 	tx := db.Create(&users)
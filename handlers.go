@@ -1,14 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/fiber/v2/middleware/session"
 	"github.com/pkg/errors"
+	goredis "github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
@@ -21,34 +22,22 @@ func AllChatsView(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
-	sessionCurrentUser, err := getLoggedInUser(c)
-	_, isUnauthorizedUserError := err.(*UnauthorizedUserError)
-	if err != nil {
-		if !isUnauthorizedUserError {
-			return errors.Wrap(err, "getLoggedInUser")
-		}
-	}
-
 	var chats []Chat
 	tx := db.Model(&Chat{}).Preload("Members").Find(&chats)
 	if tx.Error != nil {
 		return tx.Error
 	}
 
-	var user *User
-	if sessionCurrentUser != nil {
-		userEmail := sessionCurrentUser.Email
-
-		tx = db.Where("Email = ?", userEmail).First(&user)
-		if tx.Error != nil {
-			return errors.Wrap(tx.Error, "User not found")
-		}
+	currentUser := getCurrentUser(c)
+	chats, err := filterReadableChats(db, currentUser, chats)
+	if err != nil {
+		return err
 	}
 
 	return c.Render("templates/chats", fiber.Map{
 		"Chats":       chats,
 		"Mode":        "all",
-		"CurrentUser": user,
+		"CurrentUser": currentUser,
 	})
 }
 
@@ -58,25 +47,25 @@ func UserChatsView(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
-	sessionCurrentUser, err := getLoggedInUser(c)
-	if err != nil {
-		return err
-	}
-
-	userEmail := sessionCurrentUser.Email
+	currentUser := getCurrentUser(c)
 
 	var user User
-	err = db.Preload("Chats.Members").Where("Email = ?", userEmail).First(&user).Error
+	err := db.Preload("Chats.Members").First(&user, currentUser.ID).Error
 	if err != nil {
-		return errors.Wrap(err, "Get user by email")
+		return errors.Wrap(err, "Get user by id")
 	}
 
 	userChats := user.Chats
 
+	err = setChatsUnreadCount(db, currentUser, userChats)
+	if err != nil {
+		return err
+	}
+
 	return c.Render("templates/chats", fiber.Map{
 		"Chats":       userChats,
 		"Mode":        "joined",
-		"CurrentUser": *sessionCurrentUser,
+		"CurrentUser": currentUser,
 	})
 }
 
@@ -86,22 +75,24 @@ func UsersView(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
+	presenceTracker, ok := c.Locals("presence").(*PresenceTracker)
+	if !ok {
+		log.Fatal("error getting `presence` from c.Locals()")
+	}
+
 	users, err := getUsers(db)
 	if err != nil {
 		return err
 	}
 
-	sessionCurrentUser, err := getLoggedInUser(c)
+	err = setUsersPresence(c.Context(), presenceTracker, users)
 	if err != nil {
-		_, isUnauthorizedUserError := err.(*UnauthorizedUserError)
-		if !isUnauthorizedUserError {
-			return err
-		}
+		return err
 	}
 
 	return c.Render("templates/users", fiber.Map{
 		"Users":       users,
-		"CurrentUser": sessionCurrentUser,
+		"CurrentUser": getCurrentUser(c),
 	})
 }
 
@@ -122,8 +113,15 @@ func UserView(c *fiber.Ctx) error {
 		return tx.Error
 	}
 
+	currentUser := getCurrentUser(c)
+	user.Chats, err = filterReadableChats(db, currentUser, user.Chats)
+	if err != nil {
+		return err
+	}
+
 	return c.Render("templates/user", fiber.Map{
-		"User": user,
+		"User":        user,
+		"CurrentUser": currentUser,
 	})
 }
 
@@ -141,11 +139,13 @@ func ChatView(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
-	sessionCurrentUser, err := getLoggedInUser(c)
-	if err != nil {
-		return errors.Wrap(err, "getLoggedInUser")
+	presenceTracker, ok := c.Locals("presence").(*PresenceTracker)
+	if !ok {
+		log.Fatal("error getting `presence` from c.Locals()")
 	}
 
+	currentUser := getCurrentUser(c)
+
 	chatID, err := c.ParamsInt("chatID", -1)
 	if err != nil {
 		return errors.Wrap(err, "ParamsInt")
@@ -154,28 +154,42 @@ func ChatView(c *fiber.Ctx) error {
 		return errors.New("chatID param missing in URL")
 	}
 	var chat Chat
-	tx := db.Preload("Members").Where("id = ?", chatID).Preload("Messages.From").First(&chat)
+	tx := db.Preload("Members").Where("id = ?", chatID).First(&chat)
 	if tx.Error != nil {
 		return errors.Wrap(tx.Error, "get chat by id")
 	}
 
-	var user *User
-	if sessionCurrentUser != nil {
-		// todo: implement current user functionality
-		tx = db.Where("Email = ?", sessionCurrentUser.Email).First(&user)
-		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-			return errors.Wrap(tx.Error, "User not found")
-		} else if tx.Error != nil {
-			return tx.Error
-		}
+	member, err := getChatMember(db, chat.ID, currentUser.ID)
+	if err != nil {
+		return err
+	}
+	if !hasChatPermission(currentUser, &chat, member, ChatPermissionReadMessages) {
+		return &ForbiddenError{}
+	}
+
+	// changes of shown messages made after it are replayed by websocket
+	loadedAt := time.Now()
+
+	// older messages are loaded by page from `GetChatMessages`
+	messages, hasOlderMessages, err := getMessagesPage(db, chat.ID, MessagesPageQuery{})
+	if err != nil {
+		return errors.Wrap(err, "getMessagesPage")
+	}
+
+	err = setUsersPresence(c.Context(), presenceTracker, chat.Members)
+	if err != nil {
+		return err
 	}
 
 	// FIXME: if I pass `User` but with other fields and `layout` present, it
 	// does not throw an error, but it should. needs deeper look into fiber
 	// source code
 	return c.Render("templates/chat", fiber.Map{
-		"Chat":        chat,
-		"CurrentUser": user,
+		"Chat":             chat,
+		"Messages":         messages,
+		"HasOlderMessages": hasOlderMessages,
+		"LoadedAt":         loadedAt,
+		"CurrentUser":      currentUser,
 	})
 
 	// NOTE: below is a code that makes failing template realy fail
@@ -202,32 +216,8 @@ func ChatView(c *fiber.Ctx) error {
 }
 
 func HomeView(c *fiber.Ctx) error {
-	db, ok := c.Locals("db").(*gorm.DB)
-	if !ok {
-		log.Fatal("error getting `db` from c.Locals()")
-	}
-
-	sessionCurrentUser, err := getLoggedInUser(c)
-	if err != nil {
-		_, isUnauthorizedUserError := err.(*UnauthorizedUserError)
-		if isUnauthorizedUserError {
-			//
-		} else {
-			return errors.Wrap(err, "getLoggedInUser()")
-		}
-	}
-
-	var currentUser *User
-	if sessionCurrentUser != nil {
-		userEmail := sessionCurrentUser.Email
-		err = db.Where("Email = ?", userEmail).First(&currentUser).Error
-		if err != nil {
-			return errors.Wrap(err, "Get user by email")
-		}
-	}
-
 	return c.Render("templates/home", fiber.Map{
-		"CurrentUser": currentUser,
+		"CurrentUser": getCurrentUser(c),
 	})
 }
 
@@ -244,6 +234,8 @@ func getUsers(db *gorm.DB) ([]User, error) {
 type LoginRequestSchema struct {
 	Email    string
 	Password string
+	// Code is second factor, it can also be sent later to `POST /api/login/2fa`
+	Code string
 }
 
 func Login(c *fiber.Ctx) error {
@@ -262,40 +254,179 @@ func Login(c *fiber.Ctx) error {
 		return err
 	}
 
-	// TODO: implement passwords
 	var loginData LoginRequestSchema
 	err = c.BodyParser(&loginData)
 	if err != nil {
 		return errors.Wrap(err, "BodyParser")
 	}
 
-	var user User
-	err = db.Where("Email = ?", loginData.Email).Find(&user).Error
+	user, err := authenticateLogin(c, db, loginData.Email, loginData.Password)
+	if err != nil {
+		return err
+	}
+
+	isTwoFactorRequired, err := startLogin(c, db, session, user, loginData.Code)
+	if err != nil {
+		return err
+	}
+
+	if isTwoFactorRequired {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"status":            "two-factor code is required",
+			"TwoFactorRequired": true,
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status": "user was logged in",
+	})
+
+}
+
+// LoginTwoFactor finishes login of half-authenticated session
+func LoginTwoFactor(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	store, ok := c.Locals("store").(*session.Store)
+	if !ok {
+		log.Fatalf("error getting `store` from c.Locals()")
+	}
+
+	session, err := store.Get(c)
+	if err != nil {
+		return err
+	}
+
+	var data TwoFactorCodeRequestSchema
+	err = c.BodyParser(&data)
 	if err != nil {
-		return errors.Wrap(err, "Get user by email")
+		return errors.Wrap(err, "BodyParser")
 	}
 
-	currentUser := SessionCurrentUser{
-		ID:        user.ID,
-		Name:      user.Name,
-		Email:     user.Email,
-		AvatarURL: user.AvatarURL,
+	user, err := getPendingTwoFactorUser(db, session)
+	if err != nil {
+		return err
 	}
-	b, err := json.Marshal(currentUser)
+
+	err = requireTwoFactorCode(c, db, user, data.Code)
 	if err != nil {
-		return errors.Wrap(err, "json marshall currentUser")
+		return err
 	}
 
-	session.Set(SessionCurrentUserKey, string(b))
-	err = session.Save()
+	err = setSessionCurrentUser(c, session, user)
 	if err != nil {
-		return errors.Wrap(err, "session save()")
+		return err
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"status": "user was logged in",
 	})
+}
+
+// IssueToken authenticates user by email and password and returns token
+// pair for API clients that can not use cookie sessions
+func IssueToken(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	tokenManager, ok := c.Locals("tokens").(*TokenManager)
+	if !ok {
+		log.Fatal("error getting `tokens` from c.Locals()")
+	}
+
+	var loginData LoginRequestSchema
+	err := c.BodyParser(&loginData)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	user, err := authenticateLogin(c, db, loginData.Email, loginData.Password)
+	if err != nil {
+		return err
+	}
+
+	err = requireTwoFactorCode(c, db, user, loginData.Code)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := tokenManager.IssueTokens(c.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(tokens)
+}
+
+type RefreshTokenRequestSchema struct {
+	RefreshToken string `validate:"required"`
+}
+
+func RefreshToken(c *fiber.Ctx) error {
+	tokenManager, ok := c.Locals("tokens").(*TokenManager)
+	if !ok {
+		log.Fatal("error getting `tokens` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	var data RefreshTokenRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	err = validate.Struct(data)
+	if err != nil {
+		return handleValidationError(c, err)
+	}
+
+	tokens, err := tokenManager.Refresh(c.Context(), data.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(tokens)
+}
+
+// RevokeToken revokes refresh token and, when request is authenticated with
+// bearer token, the access token too
+func RevokeToken(c *fiber.Ctx) error {
+	tokenManager, ok := c.Locals("tokens").(*TokenManager)
+	if !ok {
+		log.Fatal("error getting `tokens` from c.Locals()")
+	}
 
+	var data RefreshTokenRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil && !errors.Is(err, fiber.ErrUnprocessableEntity) {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	if data.RefreshToken != "" {
+		err = tokenManager.RevokeRefreshToken(c.Context(), data.RefreshToken)
+		if err != nil {
+			return err
+		}
+	}
+
+	claims, ok := c.Locals("accessTokenClaims").(*AccessTokenClaims)
+	if ok {
+		err = tokenManager.RevokeAccessToken(c.Context(), claims)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
 func GetUsers(c *fiber.Ctx) error {
@@ -304,11 +435,21 @@ func GetUsers(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
+	presenceTracker, ok := c.Locals("presence").(*PresenceTracker)
+	if !ok {
+		log.Fatal("error getting `presence` from c.Locals()")
+	}
+
 	users, err := getUsers(db)
 	if err != nil {
 		return err
 	}
 
+	err = setUsersPresence(c.Context(), presenceTracker, users)
+	if err != nil {
+		return err
+	}
+
 	// TODO: return only requested fields, no created_at,deleted_at,messages etc for all route handlers
 	return c.JSON(fiber.Map{
 		"Users": users,
@@ -334,6 +475,11 @@ func GetUser(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
+	presenceTracker, ok := c.Locals("presence").(*PresenceTracker)
+	if !ok {
+		log.Fatal("error getting `presence` from c.Locals()")
+	}
+
 	var user User
 	userID, err := c.ParamsInt("userID")
 	if err != nil {
@@ -344,6 +490,18 @@ func GetUser(c *fiber.Ctx) error {
 		return tx.Error
 	}
 
+	user.Chats, err = filterReadableChats(db, getCurrentUser(c), user.Chats)
+	if err != nil {
+		return err
+	}
+
+	presences, err := presenceTracker.Get(c.Context(), []uint{user.ID})
+	if err != nil {
+		return err
+	}
+	presence := presences[user.ID]
+	user.Presence = &presence
+
 	return c.JSON(fiber.Map{
 		"User": user,
 	})
@@ -359,9 +517,8 @@ func CreateUser(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
-	// TODO: create schemas for all models like UserBase, UserCreate, User
-	var user User
-	err := c.BodyParser(&user)
+	var data SignupRequestSchema
+	err := c.BodyParser(&data)
 	if err != nil {
 		return err
 	}
@@ -371,29 +528,72 @@ func CreateUser(c *fiber.Ctx) error {
 		log.Fatalf("error getting `validate` from c.Locals()")
 	}
 
-	err = validate.Struct(user)
+	user, fieldErrors, err := signupUser(db, validate, data)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(err.Error())
+		return err
 	}
-	// if err != nil {
-	// 	var errors []FieldError
-	// 	for _, err := range err.(validator.ValidationErrors) {
-	// 		el := FieldError{
-	// 			Field: err.Field(),
-	// 			Tag:   err.Tag(),
-	// 			Param: err.Param(),
-	// 		}
-	// 		errors = append(errors, el)
-	// 	}
-	// 	return c.Status(fiber.StatusBadRequest).JSON(errors)
-	// }
-	tx := db.Create(&user)
-	if tx.Error != nil {
-		return tx.Error
+	if fieldErrors != nil {
+		return handleFieldErrors(c, fieldErrors)
+	}
+
+	err = sendVerificationEmail(c, user)
+	if err != nil {
+		return err
 	}
+
 	return c.JSON(user)
 }
 
+func Signup(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	store, ok := c.Locals("store").(*session.Store)
+	if !ok {
+		log.Fatalf("error getting `store` from c.Locals()")
+	}
+
+	var data SignupRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	user, fieldErrors, err := signupUser(db, validate, data)
+	if err != nil {
+		return err
+	}
+	if fieldErrors != nil {
+		return handleFieldErrors(c, fieldErrors)
+	}
+
+	err = sendVerificationEmail(c, user)
+	if err != nil {
+		return err
+	}
+
+	session, err := store.Get(c)
+	if err != nil {
+		return err
+	}
+
+	err = setSessionCurrentUser(c, session, user)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"User": user,
+	})
+}
+
 type GetChatsResponse struct {
 	Chats []Chat
 }
@@ -413,6 +613,19 @@ func GetChats(c *fiber.Ctx) error {
 		return tx.Error
 	}
 
+	currentUser := getCurrentUser(c)
+	chats, err := filterReadableChats(db, currentUser, chats)
+	if err != nil {
+		return err
+	}
+
+	if currentUser != nil {
+		err := setChatsUnreadCount(db, currentUser, chats)
+		if err != nil {
+			return err
+		}
+	}
+
 	return c.JSON(GetChatsResponse{
 		Chats: chats,
 	})
@@ -438,36 +651,96 @@ func GetChat(c *fiber.Ctx) error {
 		return err
 	}
 
-	return c.JSON(fiber.Map{
+	// private chats and their members are shown only to those who can read them
+	if chat.IsPrivate {
+		currentUser := getCurrentUser(c)
+		if currentUser == nil {
+			return &ForbiddenError{}
+		}
+
+		_, _, err = requireChatPermission(db, currentUser, chat.ID, ChatPermissionReadMessages)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(fiber.Map{
 		"Chat": chat,
 	})
 }
 
 type SendMessageRequest struct {
-	UserEmail string
-	Content   string
+	Content string
+	// ClientMessageID makes retries of the request idempotent
+	ClientMessageID string `validate:"max=64"`
 }
 
-func SendMessage(c *fiber.Ctx) error {
+type GetChatMessagesResponse struct {
+	// Messages are ordered by ID
+	Messages []Message
+	// HasMore tells whether there are more messages past the page, older ones
+	// without `after` and newer ones with it
+	HasMore bool
+}
+
+func GetChatMessages(c *fiber.Ctx) error {
 	db, ok := c.Locals("db").(*gorm.DB)
 	if !ok {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
-	sessionCurrentUser, err := getLoggedInUser(c)
+	var params struct {
+		ChatID uint
+	}
+	err := c.ParamsParser(&params)
+	if err != nil {
+		return errors.Wrap(err, "ParamsParser")
+	}
+
+	var query MessagesPageQuery
+	err = c.QueryParser(&query)
 	if err != nil {
-		_, isUnauthorizedUserError := err.(*UnauthorizedUserError)
-		if isUnauthorizedUserError {
-			return errors.Wrap(err, "isUnauthorizedUserError")
-		} else {
-			return errors.Wrap(err, "getLoggedInUser()")
-		}
+		return errors.Wrap(err, "QueryParser")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	err = validate.Struct(query)
+	if err != nil {
+		return handleValidationError(c, err)
 	}
 
+	_, _, err = requireChatPermission(db, getCurrentUser(c), params.ChatID, ChatPermissionReadMessages)
+	if err != nil {
+		return err
+	}
+
+	messages, hasMore, err := getMessagesPage(db, params.ChatID, query)
+	if err != nil {
+		return errors.Wrap(err, "getMessagesPage")
+	}
+
+	return c.JSON(GetChatMessagesResponse{
+		Messages: messages,
+		HasMore:  hasMore,
+	})
+}
+
+func SendMessage(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	currentUser := getCurrentUser(c)
+
 	var params struct {
 		ChatID int
 	}
-	err = c.ParamsParser(&params)
+	err := c.ParamsParser(&params)
 	if err != nil {
 		return errors.Wrap(err, "ParamsParser")
 	}
@@ -488,16 +761,81 @@ func SendMessage(c *fiber.Ctx) error {
 		return handleValidationError(c, err)
 	}
 
-	messageID, err := saveMessage(db, sessionCurrentUser.Email, uint(params.ChatID), data.Content)
+	err = requireChatMember(db, currentUser, uint(params.ChatID))
+	if err != nil {
+		return err
+	}
+
+	message, isCreated, err := saveMessage(db, currentUser.ID, uint(params.ChatID), data.Content, data.ClientMessageID)
 	if err != nil {
 		return err
 	}
 
+	if isCreated {
+		broker, ok := c.Locals("broker").(Broker)
+		if !ok {
+			log.Fatal("error getting `broker` from c.Locals()")
+		}
+
+		err = publishNewMessage(c.Context(), db, broker, currentUser, message, "")
+		if err != nil {
+			return err
+		}
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"ID": messageID,
+		"ID":        message.ID,
+		"IsDeleted": message.DeletedAt.Valid,
 	})
 }
 
+type MarkChatReadRequest struct {
+	MessageID uint `validate:"required"`
+}
+
+func MarkChatRead(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	broker, ok := c.Locals("broker").(Broker)
+	if !ok {
+		log.Fatal("error getting `broker` from c.Locals()")
+	}
+
+	var params struct {
+		ChatID uint
+	}
+	err := c.ParamsParser(&params)
+	if err != nil {
+		return errors.Wrap(err, "ParamsParser")
+	}
+
+	var data MarkChatReadRequest
+	err = c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser failed")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	err = validate.Struct(data)
+	if err != nil {
+		return handleValidationError(c, err)
+	}
+
+	err = markChatRead(c.Context(), db, broker, getCurrentUser(c), params.ChatID, data.MessageID)
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
 func RootHandler(c *fiber.Ctx) error {
 	return c.Redirect("/ui", fiber.StatusPermanentRedirect)
 }
@@ -509,6 +847,7 @@ func LoginView(c *fiber.Ctx) error {
 type UserAuthSchema struct {
 	Email    string
 	Password string
+	Code     string
 }
 
 func PostLoginView(c *fiber.Ctx) error {
@@ -533,28 +872,87 @@ func PostLoginView(c *fiber.Ctx) error {
 		return err
 	}
 
-	var user *User
-	tx := db.Where("Email = ?", data.Email).First(&user)
-	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-		// NOTE: creating user if it does not exist for v1
-		return handleNewUserLogin(c, db, session, data)
-	} else if tx.Error != nil {
-		return tx.Error
+	user, err := authenticateLogin(c, db, data.Email, data.Password)
+	if err != nil {
+		_, isInvalidCredentialsError := err.(*InvalidCredentialsError)
+		_, isTooManyLoginAttemptsError := err.(*TooManyLoginAttemptsError)
+		if isInvalidCredentialsError || isTooManyLoginAttemptsError {
+			return c.Status(getErrorStatusCode(err)).Render("templates/login", fiber.Map{
+				"Error": err.Error(),
+			})
+		}
+		return err
+	}
+
+	isTwoFactorRequired, err := startLogin(c, db, session, user, data.Code)
+	if err != nil {
+		_, isInvalidTwoFactorCodeError := err.(*InvalidTwoFactorCodeError)
+		_, isTooManyLoginAttemptsError := err.(*TooManyLoginAttemptsError)
+		if isInvalidTwoFactorCodeError || isTooManyLoginAttemptsError {
+			return c.Status(getErrorStatusCode(err)).Render("templates/login", fiber.Map{
+				"Error": err.Error(),
+			})
+		}
+		return err
+	}
+
+	if isTwoFactorRequired {
+		return c.Render("templates/two_factor", fiber.Map{})
+	}
+
+	return c.Render("templates/home", fiber.Map{
+		"CurrentUser": user,
+	})
+}
+
+type TwoFactorSchema struct {
+	Code string
+}
+
+func PostTwoFactorView(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	var data TwoFactorSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return err
 	}
 
-	sessionCurrentUser := SessionCurrentUser{
-		ID:        user.ID,
-		Name:      user.Name,
-		Email:     user.Email,
-		AvatarURL: user.AvatarURL,
+	store, ok := c.Locals("store").(*session.Store)
+	if !ok {
+		log.Fatalf("error getting `store` from c.Locals()")
+	}
+
+	session, err := store.Get(c)
+	if err != nil {
+		return err
 	}
-	b, err := json.Marshal(sessionCurrentUser)
+
+	user, err := getPendingTwoFactorUser(db, session)
+	if err != nil {
+		_, isUnauthorizedUserError := err.(*UnauthorizedUserError)
+		if isUnauthorizedUserError {
+			return c.Redirect("/ui/login", fiber.StatusSeeOther)
+		}
+		return err
+	}
+
+	err = requireTwoFactorCode(c, db, user, data.Code)
 	if err != nil {
+		_, isInvalidTwoFactorCodeError := err.(*InvalidTwoFactorCodeError)
+		_, isTooManyLoginAttemptsError := err.(*TooManyLoginAttemptsError)
+		if isInvalidTwoFactorCodeError || isTooManyLoginAttemptsError {
+			return c.Status(getErrorStatusCode(err)).Render("templates/two_factor", fiber.Map{
+				"Error": err.Error(),
+			})
+		}
 		return err
 	}
-	sessionCurrentUserJSON := string(b)
-	session.Set(SessionCurrentUserKey, sessionCurrentUserJSON)
-	err = session.Save()
+
+	err = setSessionCurrentUser(c, session, user)
 	if err != nil {
 		return err
 	}
@@ -564,37 +962,61 @@ func PostLoginView(c *fiber.Ctx) error {
 	})
 }
 
-func handleNewUserLogin(c *fiber.Ctx, db *gorm.DB, session *session.Session, data UserAuthSchema) error {
-	// password is not used anywhere
+func SignupView(c *fiber.Ctx) error {
+	return c.Render("templates/signup", fiber.Map{})
+}
 
-	createdUser := User{
-		Email:    data.Email,
-		Password: data.Password,
+func PostSignupView(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
 	}
-	tx := db.Create(&createdUser)
-	if tx.Error != nil {
-		return tx.Error
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	store, ok := c.Locals("store").(*session.Store)
+	if !ok {
+		log.Fatalf("error getting `store` from c.Locals()")
+	}
+
+	var data SignupRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return err
+	}
+
+	user, fieldErrors, err := signupUser(db, validate, data)
+	if err != nil {
+		return err
+	}
+	if fieldErrors != nil {
+		return c.Status(fiber.StatusBadRequest).Render("templates/signup", fiber.Map{
+			"Errors": fieldErrors,
+			"Name":   data.Name,
+			"Email":  data.Email,
+		})
 	}
 
-	sessionCurrentUser := SessionCurrentUser{
-		ID:        createdUser.ID,
-		Name:      createdUser.Name,
-		Email:     createdUser.Email,
-		AvatarURL: createdUser.AvatarURL,
+	err = sendVerificationEmail(c, user)
+	if err != nil {
+		return err
 	}
-	b, err := json.Marshal(sessionCurrentUser)
+
+	session, err := store.Get(c)
 	if err != nil {
 		return err
 	}
-	sessionCurrentUserJSON := string(b)
-	session.Set(SessionCurrentUserKey, sessionCurrentUserJSON)
-	err = session.Save()
+
+	err = setSessionCurrentUser(c, session, user)
 	if err != nil {
 		return err
 	}
 
 	return c.Render("templates/home", fiber.Map{
-		"CurrentUser": createdUser,
+		"CurrentUser": user,
 	})
 }
 
@@ -604,6 +1026,15 @@ func UploadUserAvatar(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
+	userID, err := c.ParamsInt("userID")
+	if err != nil {
+		return errors.Wrap(err, "ParamsInt")
+	}
+
+	if uint(userID) != getCurrentUser(c).ID {
+		return &ForbiddenError{}
+	}
+
 	file, err := c.FormFile("image")
 	if err != nil {
 		return err
@@ -621,7 +1052,6 @@ func UploadUserAvatar(c *fiber.Ctx) error {
 		return err
 	}
 
-	userID := c.Params("userID")
 	tx := db.Model(&User{}).Where("id = ?", userID).Update("AvatarURL", fmt.Sprintf("/%s", fileName))
 	if tx.Error != nil {
 		return tx.Error
@@ -638,44 +1068,891 @@ func JoinChat(c *fiber.Ctx) error {
 		log.Fatal("error getting `db` from c.Locals()")
 	}
 
-	var body struct {
-		Email string
+	user := getCurrentUser(c)
+
+	var params struct {
+		ChatID uint
+	}
+	err := c.ParamsParser(&params)
+	if err != nil {
+		return errors.Wrap(err, "ParamsParser")
+	}
+
+	chat, _, err := requireChatPermission(db, user, params.ChatID, ChatPermissionJoin)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = addChatMember(db, chat.ID, user.ID, ChatRoleMember)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type CreateChatRequestSchema struct {
+	Name      string `validate:"required"`
+	IsPrivate bool
+}
+
+func CreateChat(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
 	}
 
-	err := c.BodyParser(&body)
+	var data CreateChatRequestSchema
+	err := c.BodyParser(&data)
 	if err != nil {
 		return errors.Wrap(err, "BodyParser")
 	}
 
-	var user User
-	tx := db.Where("Email = ?", body.Email).First(&user)
-	if tx.Error != nil {
-		return errors.Wrap(tx.Error, "Filter User by Email")
+	err = validate.Struct(data)
+	if err != nil {
+		return handleValidationError(c, err)
 	}
 
-	var params struct {
-		ChatID uint
+	chat := Chat{
+		Name:      data.Name,
+		IsPrivate: data.IsPrivate,
 	}
-	err = c.ParamsParser(&params)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&chat).Error
+		if err != nil {
+			return errors.Wrap(err, "Create chat")
+		}
+
+		_, _, err = addChatMember(tx, chat.ID, getCurrentUser(c).ID, ChatRoleOwner)
+		if err != nil {
+			return errors.Wrap(err, "Create chat owner")
+		}
+
+		return nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "ParamsParser")
+		return err
 	}
 
-	var chat Chat
-	tx = db.Find(&chat, params.ChatID)
-	if tx.Error != nil {
-		return errors.Wrap(tx.Error, "Find Chat by ID")
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"Chat": chat,
+	})
+}
+
+type RenameChatRequestSchema struct {
+	Name string `validate:"required"`
+}
+
+func RenameChat(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	chatID, err := c.ParamsInt("chatID")
+	if err != nil {
+		return errors.Wrap(err, "ParamsInt")
 	}
 
-	err = db.Model(&chat).Association("Members").Append(&user)
+	var data RenameChatRequestSchema
+	err = c.BodyParser(&data)
 	if err != nil {
-		return errors.Wrap(err, "Chat appends member")
+		return errors.Wrap(err, "BodyParser")
 	}
 
-	err = db.Save(&user).Error
+	err = validate.Struct(data)
 	if err != nil {
-		return errors.Wrap(err, "Save Chat after Members Update")
+		return handleValidationError(c, err)
 	}
 
-	return nil
+	chat, _, err := requireChatPermission(db, getCurrentUser(c), uint(chatID), ChatPermissionRename)
+	if err != nil {
+		return err
+	}
+
+	err = db.Model(chat).Update("Name", data.Name).Error
+	if err != nil {
+		return errors.Wrap(err, "Update chat name")
+	}
+
+	return c.JSON(fiber.Map{
+		"Chat": chat,
+	})
+}
+
+func DeleteChat(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	chatID, err := c.ParamsInt("chatID")
+	if err != nil {
+		return errors.Wrap(err, "ParamsInt")
+	}
+
+	chat, _, err := requireChatPermission(db, getCurrentUser(c), uint(chatID), ChatPermissionDelete)
+	if err != nil {
+		return err
+	}
+
+	err = db.Delete(chat).Error
+	if err != nil {
+		return errors.Wrap(err, "Delete chat")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// AddChatMember adds another user to chat as a member. Adding existing member
+// does nothing
+func AddChatMember(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	var params struct {
+		ChatID uint
+		UserID uint
+	}
+	err := c.ParamsParser(&params)
+	if err != nil {
+		return errors.Wrap(err, "ParamsParser")
+	}
+
+	_, _, err = requireChatPermission(db, getCurrentUser(c), params.ChatID, ChatPermissionManageMembers)
+	if err != nil {
+		return err
+	}
+
+	var user User
+	err = db.First(&user, params.UserID).Error
+	if err != nil {
+		return errors.Wrap(err, "Get user by id")
+	}
+
+	member, isCreated, err := addChatMember(db, params.ChatID, user.ID, ChatRoleMember)
+	if err != nil {
+		return err
+	}
+	if !isCreated {
+		return c.JSON(fiber.Map{
+			"Member": member,
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"Member": member,
+	})
+}
+
+func RemoveChatMember(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	var params struct {
+		ChatID uint
+		UserID uint
+	}
+	err := c.ParamsParser(&params)
+	if err != nil {
+		return errors.Wrap(err, "ParamsParser")
+	}
+
+	var chat Chat
+	err = db.First(&chat, params.ChatID).Error
+	if err != nil {
+		return errors.Wrap(err, "Get chat by id")
+	}
+
+	currentUser := getCurrentUser(c)
+	actor, err := getChatMember(db, params.ChatID, currentUser.ID)
+	if err != nil {
+		return err
+	}
+
+	target, err := getChatMember(db, params.ChatID, params.UserID)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return fiber.ErrNotFound
+	}
+
+	if !canRemoveChatMember(currentUser, &chat, actor, target) {
+		return &ForbiddenError{}
+	}
+
+	err = db.Delete(target).Error
+	if err != nil {
+		return errors.Wrap(err, "Delete chat member")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type SetChatMemberRoleRequestSchema struct {
+	Role string `validate:"required,oneof=admin member"`
+}
+
+func SetChatMemberRole(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	var params struct {
+		ChatID uint
+		UserID uint
+	}
+	err := c.ParamsParser(&params)
+	if err != nil {
+		return errors.Wrap(err, "ParamsParser")
+	}
+
+	var data SetChatMemberRoleRequestSchema
+	err = c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	err = validate.Struct(data)
+	if err != nil {
+		return handleValidationError(c, err)
+	}
+
+	_, _, err = requireChatPermission(db, getCurrentUser(c), params.ChatID, ChatPermissionManageRoles)
+	if err != nil {
+		return err
+	}
+
+	target, err := getChatMember(db, params.ChatID, params.UserID)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return fiber.ErrNotFound
+	}
+	if target.Role == ChatRoleOwner {
+		return &ForbiddenError{}
+	}
+
+	err = db.Model(target).Update("Role", data.Role).Error
+	if err != nil {
+		return errors.Wrap(err, "Update chat member role")
+	}
+
+	return c.JSON(fiber.Map{
+		"Member": target,
+	})
+}
+
+type EditChatMessageRequest struct {
+	Content string `validate:"required"`
+}
+
+func EditChatMessage(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	broker, ok := c.Locals("broker").(Broker)
+	if !ok {
+		log.Fatal("error getting `broker` from c.Locals()")
+	}
+
+	var params struct {
+		ChatID    uint
+		MessageID uint
+	}
+	err := c.ParamsParser(&params)
+	if err != nil {
+		return errors.Wrap(err, "ParamsParser")
+	}
+
+	var data EditChatMessageRequest
+	err = c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser failed")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	err = validate.Struct(data)
+	if err != nil {
+		return handleValidationError(c, err)
+	}
+
+	message, err := editChatMessage(c.Context(), db, broker, getCurrentUser(c), params.ChatID, params.MessageID, data.Content)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(message)
+}
+
+func DeleteChatMessage(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	broker, ok := c.Locals("broker").(Broker)
+	if !ok {
+		log.Fatal("error getting `broker` from c.Locals()")
+	}
+
+	var params struct {
+		ChatID    uint
+		MessageID uint
+	}
+	err := c.ParamsParser(&params)
+	if err != nil {
+		return errors.Wrap(err, "ParamsParser")
+	}
+
+	err = deleteChatMessage(c.Context(), db, broker, getCurrentUser(c), params.ChatID, params.MessageID)
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type SetUserAdminRequestSchema struct {
+	IsAdmin bool
+}
+
+func SetUserAdmin(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	userID, err := c.ParamsInt("userID")
+	if err != nil {
+		return errors.Wrap(err, "ParamsInt")
+	}
+
+	var data SetUserAdminRequestSchema
+	err = c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	var user User
+	err = db.First(&user, userID).Error
+	if err != nil {
+		return errors.Wrap(err, "Get user by id")
+	}
+
+	if data.IsAdmin && !user.TOTPEnabled {
+		return fiber.NewError(fiber.StatusConflict, "user must enable two-factor authentication before becoming admin")
+	}
+
+	err = db.Model(&user).Update("IsAdmin", data.IsAdmin).Error
+	if err != nil {
+		return errors.Wrap(err, "Update user admin flag")
+	}
+
+	return c.JSON(fiber.Map{
+		"User": user,
+	})
+}
+
+// Logout destroys session of request and revokes access token when request
+// is authenticated with bearer token
+func Logout(c *fiber.Ctx) error {
+	claims, ok := c.Locals("accessTokenClaims").(*AccessTokenClaims)
+	if ok {
+		tokenManager, ok := c.Locals("tokens").(*TokenManager)
+		if !ok {
+			log.Fatal("error getting `tokens` from c.Locals()")
+		}
+
+		err := tokenManager.RevokeAccessToken(c.Context(), claims)
+		if err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	registry, ok := c.Locals("sessions").(*SessionRegistry)
+	if !ok {
+		log.Fatal("error getting `sessions` from c.Locals()")
+	}
+
+	store, ok := c.Locals("store").(*session.Store)
+	if !ok {
+		log.Fatalf("error getting `store` from c.Locals()")
+	}
+
+	sessionID, _ := c.Locals("sessionID").(string)
+	err := registry.Revoke(c.Context(), getCurrentUser(c).ID, sessionID)
+	if err != nil && !errors.Is(err, fiber.ErrNotFound) {
+		return err
+	}
+
+	session, err := store.Get(c)
+	if err != nil {
+		return err
+	}
+	err = session.Destroy()
+	if err != nil {
+		return errors.Wrap(err, "session destroy()")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func GetSessions(c *fiber.Ctx) error {
+	registry, ok := c.Locals("sessions").(*SessionRegistry)
+	if !ok {
+		log.Fatal("error getting `sessions` from c.Locals()")
+	}
+
+	sessions, err := registry.List(c.Context(), getCurrentUser(c).ID)
+	if err != nil {
+		return err
+	}
+
+	currentSessionID, _ := c.Locals("sessionID").(string)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+
+	return c.JSON(fiber.Map{
+		"Sessions": sessions,
+	})
+}
+
+func RevokeSession(c *fiber.Ctx) error {
+	registry, ok := c.Locals("sessions").(*SessionRegistry)
+	if !ok {
+		log.Fatal("error getting `sessions` from c.Locals()")
+	}
+
+	err := registry.Revoke(c.Context(), getCurrentUser(c).ID, c.Params("sessionID"))
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RevokeOtherSessions revokes every session of user except the one of request
+func RevokeOtherSessions(c *fiber.Ctx) error {
+	registry, ok := c.Locals("sessions").(*SessionRegistry)
+	if !ok {
+		log.Fatal("error getting `sessions` from c.Locals()")
+	}
+
+	currentUser := getCurrentUser(c)
+	sessions, err := registry.List(c.Context(), currentUser.ID)
+	if err != nil {
+		return err
+	}
+
+	currentSessionID, _ := c.Locals("sessionID").(string)
+	for _, sessionInfo := range sessions {
+		if sessionInfo.ID == currentSessionID {
+			continue
+		}
+
+		err = registry.Revoke(c.Context(), currentUser.ID, sessionInfo.ID)
+		if err != nil && !errors.Is(err, fiber.ErrNotFound) {
+			return err
+		}
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type VerifyEmailRequestSchema struct {
+	Token string `validate:"required"`
+}
+
+func VerifyEmail(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	var data VerifyEmailRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	err = validate.Struct(data)
+	if err != nil {
+		return handleValidationError(c, err)
+	}
+
+	err = verifyEmail(c, db, data.Token)
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func VerifyEmailView(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	err := verifyEmail(c, db, c.Query("token"))
+	if err != nil {
+		_, isInvalidTokenError := err.(*InvalidTokenError)
+		if isInvalidTokenError {
+			return c.Status(fiber.StatusBadRequest).Render("templates/verify_email", fiber.Map{
+				"Error":       "verification link is invalid or expired",
+				"CurrentUser": getCurrentUser(c),
+			})
+		}
+		return err
+	}
+
+	return c.Render("templates/verify_email", fiber.Map{
+		"CurrentUser": getCurrentUser(c),
+	})
+}
+
+func ResendVerificationEmail(c *fiber.Ctx) error {
+	user := getCurrentUser(c)
+	if user.EmailVerifiedAt != nil {
+		return fiber.NewError(fiber.StatusConflict, "email is already verified")
+	}
+
+	err := sendVerificationEmail(c, user)
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type RequestPasswordResetRequestSchema struct {
+	Email string `validate:"required,email"`
+}
+
+func RequestPasswordReset(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	var data RequestPasswordResetRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	err = validate.Struct(data)
+	if err != nil {
+		return handleValidationError(c, err)
+	}
+
+	err = sendPasswordResetEmail(c, db, data.Email)
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+func ConfirmPasswordReset(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	var data ResetPasswordRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	err = validate.Struct(data)
+	if err != nil {
+		return handleValidationError(c, err)
+	}
+
+	err = resetPassword(c, db, data)
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func ForgotPasswordView(c *fiber.Ctx) error {
+	return c.Render("templates/forgot_password", fiber.Map{})
+}
+
+func PostForgotPasswordView(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	var data RequestPasswordResetRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return err
+	}
+
+	err = sendPasswordResetEmail(c, db, data.Email)
+	if err != nil {
+		return err
+	}
+
+	return c.Render("templates/forgot_password", fiber.Map{
+		"Sent": true,
+	})
+}
+
+func ResetPasswordView(c *fiber.Ctx) error {
+	return c.Render("templates/reset_password", fiber.Map{
+		"Token": c.Query("token"),
+	})
+}
+
+func PostResetPasswordView(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	validate, ok := c.Locals("validate").(*validator.Validate)
+	if !ok {
+		log.Fatalf("error getting `validate` from c.Locals()")
+	}
+
+	var data ResetPasswordRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return err
+	}
+
+	err = validate.Struct(data)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).Render("templates/reset_password", fiber.Map{
+			"Token":  data.Token,
+			"Errors": getFieldErrors(err),
+		})
+	}
+
+	err = resetPassword(c, db, data)
+	if err != nil {
+		_, isInvalidTokenError := err.(*InvalidTokenError)
+		if isInvalidTokenError {
+			return c.Status(fiber.StatusBadRequest).Render("templates/reset_password", fiber.Map{
+				"Error": "reset link is invalid or expired",
+			})
+		}
+		return err
+	}
+
+	return c.Redirect("/ui/login", fiber.StatusSeeOther)
+}
+
+// EnrollTwoFactor generates new TOTP secret for current user. Second factor
+// is not required until it is confirmed with `ConfirmTwoFactor`
+func EnrollTwoFactor(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	user := getCurrentUser(c)
+	if user.TOTPEnabled {
+		return fiber.NewError(fiber.StatusConflict, "two-factor authentication is already enabled")
+	}
+
+	enrollment, err := generateTOTPKey(user)
+	if err != nil {
+		return err
+	}
+
+	err = db.Model(user).Update("TOTPSecret", enrollment.Secret).Error
+	if err != nil {
+		return errors.Wrap(err, "Update user totp secret")
+	}
+
+	return c.JSON(enrollment)
+}
+
+type TwoFactorCodeRequestSchema struct {
+	Code string
+}
+
+// ConfirmTwoFactor enables second factor after user proves that
+// authenticator was set up, and returns recovery codes. Recovery codes are
+// shown only once
+func ConfirmTwoFactor(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	redisClient, ok := c.Locals("redis").(goredis.UniversalClient)
+	if !ok {
+		log.Fatal("error getting `redis` from c.Locals()")
+	}
+
+	var data TwoFactorCodeRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	user := getCurrentUser(c)
+	if user.TOTPEnabled {
+		return fiber.NewError(fiber.StatusConflict, "two-factor authentication is already enabled")
+	}
+	if user.TOTPSecret == "" {
+		return fiber.NewError(fiber.StatusConflict, "two-factor authentication enrollment was not started")
+	}
+
+	isValid, err := validateTOTPCode(c.Context(), redisClient, user.ID, user.TOTPSecret, data.Code)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		return &InvalidTwoFactorCodeError{}
+	}
+
+	recoveryCodes, err := generateRecoveryCodes(db, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = db.Model(user).Update("TOTPEnabled", true).Error
+	if err != nil {
+		return errors.Wrap(err, "Update user totp enabled")
+	}
+
+	return c.JSON(fiber.Map{
+		"RecoveryCodes": recoveryCodes,
+	})
+}
+
+// DisableTwoFactor turns second factor off, it requires valid code so that
+// stolen session can not do it
+func DisableTwoFactor(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	var data TwoFactorCodeRequestSchema
+	err := c.BodyParser(&data)
+	if err != nil {
+		return errors.Wrap(err, "BodyParser")
+	}
+
+	user := getCurrentUser(c)
+	if !user.TOTPEnabled {
+		return fiber.NewError(fiber.StatusConflict, "two-factor authentication is not enabled")
+	}
+	if user.IsAdmin {
+		return fiber.NewError(fiber.StatusConflict, "admins can not disable two-factor authentication")
+	}
+
+	err = requireTwoFactorCode(c, db, user, data.Code)
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]any{
+			"TOTPEnabled": false,
+			"TOTPSecret":  "",
+		}).Error
+		if err != nil {
+			return errors.Wrap(err, "Update user totp")
+		}
+
+		err = tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return errors.Wrap(err, "Delete recovery codes")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// UnlockUserLogin removes login lock of user caused by failed login attempts
+func UnlockUserLogin(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	throttle, ok := c.Locals("loginThrottle").(*LoginThrottle)
+	if !ok {
+		log.Fatal("error getting `loginThrottle` from c.Locals()")
+	}
+
+	userID, err := c.ParamsInt("userID")
+	if err != nil {
+		return errors.Wrap(err, "ParamsInt")
+	}
+
+	var user User
+	err = db.First(&user, userID).Error
+	if err != nil {
+		return errors.Wrap(err, "Get user by id")
+	}
+
+	err = throttle.Unlock(c.Context(), user.Email)
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,9 +11,11 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	fiberwebsocket "github.com/gofiber/contrib/websocket"
 	"github.com/posener/wstest"
@@ -21,6 +25,8 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/utils"
 	"github.com/gorilla/websocket"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func testStatus200(t *testing.T, app *fiber.App, url, method string) []byte {
@@ -82,8 +88,12 @@ func TestUploadUserAvatar(t *testing.T) {
 
 	writer.Close()
 
+	sessionCookie := getLoggedInUserSessionCookie(t, app, *user)
+
 	req := httptest.NewRequest(fiber.MethodPost, fmt.Sprintf("/api/users/%d/avatar", user.ID), body)
 	req.Header.Add("Content-Type", writer.FormDataContentType())
+	req.AddCookie(sessionCookie)
+	req.Header.Set(CSRFTokenHeader, getAPICSRFToken(t, app, sessionCookie))
 
 	resp, err := app.Test(req)
 	utils.AssertEqual(t, nil, err)
@@ -193,19 +203,22 @@ func TestJoinChat(t *testing.T) {
 	chat, err := addRandomChatWithNoUsers(DB)
 	utils.AssertEqual(t, nil, err)
 
-	chatsLenInitial := len(user.Chats)
-	data := struct {
-		Email string
-	}{
-		Email: user.Email,
+	// history sent before user joined is not unread for them
+	sender, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+	var lastMessage *Message
+	for i := 0; i < 3; i++ {
+		lastMessage, _, err = saveMessage(DB, sender.ID, chat.ID, fmt.Sprintf("message %d", i), "")
+		utils.AssertEqual(t, nil, err)
 	}
 
-	jsonData, err := json.Marshal(data)
-	utils.AssertEqual(t, nil, err)
+	chatsLenInitial := len(user.Chats)
 
-	body := bytes.NewReader(jsonData)
-	req := httptest.NewRequest(fiber.MethodPost, fmt.Sprintf("/api/chats/%d/users", chat.ID), body)
-	req.Header.Set("Content-Type", "application/json")
+	sessionCookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	req := httptest.NewRequest(fiber.MethodPost, fmt.Sprintf("/api/chats/%d/users", chat.ID), nil)
+	req.AddCookie(sessionCookie)
+	req.Header.Set(CSRFTokenHeader, getAPICSRFToken(t, app, sessionCookie))
 	resp, err := app.Test(req)
 	utils.AssertEqual(t, nil, err)
 	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "Status code")
@@ -224,6 +237,14 @@ func TestJoinChat(t *testing.T) {
 		}
 	}
 	utils.AssertEqual(t, true, isChatFound)
+
+	member, err := getChatMember(DB, chat.ID, user.ID)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, lastMessage.ID, member.LastReadMessageID)
+
+	unreadCounts, err := getUnreadCounts(DB, user.ID)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, int64(0), unreadCounts[chat.ID])
 }
 
 func TestSendMessageToWebsocket(t *testing.T) {
@@ -419,6 +440,9 @@ func TestPostLoginViewWithExistingUser(t *testing.T) {
 	body := bytes.NewReader(b)
 	loginReq := httptest.NewRequest(fiber.MethodPost, "/ui/login", body)
 	loginReq.Header.Set("Content-Type", "application/json")
+	csrfToken, csrfCookie := getCSRFToken(t, app)
+	loginReq.Header.Set(CSRFTokenHeader, csrfToken)
+	loginReq.AddCookie(csrfCookie)
 	resp, err := app.Test(loginReq)
 	utils.AssertEqual(t, nil, err)
 	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
@@ -451,28 +475,89 @@ func TestPostLoginViewWithNonExistingUser(t *testing.T) {
 	body := bytes.NewReader(b)
 	loginReq := httptest.NewRequest(fiber.MethodPost, "/ui/login", body)
 	loginReq.Header.Set("Content-Type", "application/json")
+	csrfToken, csrfCookie := getCSRFToken(t, app)
+	loginReq.Header.Set(CSRFTokenHeader, csrfToken)
+	loginReq.AddCookie(csrfCookie)
 	resp, err := app.Test(loginReq)
 	utils.AssertEqual(t, nil, err)
-	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
 
-	cookies := resp.Cookies()
-	var sessionCookie *http.Cookie
-	for _, c := range cookies {
-		if c.Name == SessionIDCookieKey {
-			sessionCookie = c
+	var usersCount int64
+	err = DB.Model(&User{}).Where("Email = ?", email).Count(&usersCount).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, int64(0), usersCount, "login must not create users")
+}
+
+func TestPostLoginViewWithWrongPassword(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	v := LoginRequestSchema{
+		Email:    user.Email,
+		Password: "wrong-password",
+	}
+	b, err := json.Marshal(v)
+	utils.AssertEqual(t, nil, err)
+	loginReq := httptest.NewRequest(fiber.MethodPost, "/ui/login", bytes.NewReader(b))
+	loginReq.Header.Set("Content-Type", "application/json")
+	csrfToken, csrfCookie := getCSRFToken(t, app)
+	loginReq.Header.Set(CSRFTokenHeader, csrfToken)
+	loginReq.AddCookie(csrfCookie)
+	resp, err := app.Test(loginReq)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	for _, c := range resp.Cookies() {
+		if c.Name == SessionIDCookieKey && c.Value != "" {
+			t.Error("session cookie is set for invalid credentials")
 		}
 	}
+}
 
-	if sessionCookie == nil {
-		t.Error("empty session cookie")
+func TestLoginWithWrongPassword(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	for _, email := range []string{user.Email, "unknown@test.com"} {
+		v := LoginRequestSchema{
+			Email:    email,
+			Password: "wrong-password",
+		}
+		b, err := json.Marshal(v)
+		utils.AssertEqual(t, nil, err)
+		req := httptest.NewRequest(fiber.MethodPost, "/api/login", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, email)
 	}
+}
 
-	var createdUser User
-	err = DB.Where("Email = ?", email).Find(&createdUser).Error
+func TestLoginRehashesPassword(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	outdatedHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost+1)
+	utils.AssertEqual(t, nil, err)
+	err = DB.Model(&User{}).Where("id = ?", user.ID).Update("PasswordHash", string(outdatedHash)).Error
 	utils.AssertEqual(t, nil, err)
 
-	utils.AssertEqual(t, email, createdUser.Email)
-	utils.AssertEqual(t, password, createdUser.Password)
+	getLoggedInUserSessionCookie(t, app, *user)
+
+	var updatedUser User
+	err = DB.First(&updatedUser, user.ID).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, false, passwordNeedsRehash(updatedUser.PasswordHash))
+	utils.AssertEqual(t, true, verifyPassword(updatedUser.PasswordHash, user.Password))
 }
 
 func TestRenderUsers(t *testing.T) {
@@ -599,12 +684,19 @@ func TestGetUser(t *testing.T) {
 }
 
 func TestCreateUser(t *testing.T) {
-	app, _, teardownTest := setupTest(t)
+	app, DB, teardownTest := setupTest(t)
 	defer teardownTest()
 
+	currentUser, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+	err = DB.Model(currentUser).Update("IsAdmin", true).Error
+	utils.AssertEqual(t, nil, err)
+	sessionCookie := getLoggedInUserSessionCookie(t, app, *currentUser)
+
 	userToCreate := User{
-		Name:  "test",
-		Email: "test@gmail.com",
+		Name:     "test",
+		Email:    "test@gmail.com",
+		Password: "password123",
 	}
 
 	b, err := json.Marshal(userToCreate)
@@ -614,6 +706,8 @@ func TestCreateUser(t *testing.T) {
 
 	req := httptest.NewRequest(fiber.MethodPost, "/api/users", body)
 	req.Header.Add("Content-Type", "application/json")
+	req.AddCookie(sessionCookie)
+	req.Header.Set(CSRFTokenHeader, getAPICSRFToken(t, app, sessionCookie))
 	resp, err := app.Test(req)
 	utils.AssertEqual(t, nil, err)
 	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "Status code")
@@ -627,6 +721,120 @@ func TestCreateUser(t *testing.T) {
 
 	utils.AssertEqual(t, userToCreate.Name, v.Name)
 	utils.AssertEqual(t, userToCreate.Email, v.Email)
+	utils.AssertEqual(t, "", v.Password)
+}
+
+func postSignup(t *testing.T, app *fiber.App, data SignupRequestSchema) *http.Response {
+	t.Helper()
+
+	b, err := json.Marshal(data)
+	utils.AssertEqual(t, nil, err)
+
+	req := httptest.NewRequest(fiber.MethodPost, "/api/signup", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+
+	return resp
+}
+
+func TestSignup(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	data := SignupRequestSchema{
+		Name:     "test",
+		Email:    "test@test.com",
+		Password: "password123",
+	}
+	resp := postSignup(t, app, data)
+	utils.AssertEqual(t, fiber.StatusCreated, resp.StatusCode, "Status code")
+
+	var sessionCookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == SessionIDCookieKey {
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil {
+		t.Error("empty session cookie")
+	}
+
+	var createdUser User
+	err := DB.Where("Email = ?", data.Email).First(&createdUser).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, data.Name, createdUser.Name)
+	utils.AssertEqual(t, true, verifyPassword(createdUser.PasswordHash, data.Password))
+
+	// emails are compared case insensitively
+	user := User{Email: strings.ToUpper(data.Email), Password: data.Password}
+	getLoggedInUserSessionCookie(t, app, user)
+}
+
+func TestSignupValidation(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	existingUser, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	testCases := []struct {
+		data          SignupRequestSchema
+		expectedField string
+		expectedTag   string
+	}{
+		{SignupRequestSchema{Email: "a@test.com", Password: "password123"}, "Name", "required"},
+		{SignupRequestSchema{Name: "a", Email: "not-an-email", Password: "password123"}, "Email", "email"},
+		{SignupRequestSchema{Name: "a", Email: "a@test.com", Password: "short1"}, "Password", "password"},
+		{SignupRequestSchema{Name: "a", Email: "a@test.com", Password: "onlyletters"}, "Password", "password"},
+		{SignupRequestSchema{Name: "a", Email: existingUser.Email, Password: "password123"}, "Email", "unique"},
+		{SignupRequestSchema{Name: "a", Email: strings.ToUpper(existingUser.Email), Password: "password123"}, "Email", "unique"},
+	}
+
+	for _, tc := range testCases {
+		resp := postSignup(t, app, tc.data)
+		utils.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode, tc.expectedTag)
+
+		var fieldErrors []FieldError
+		err := json.NewDecoder(resp.Body).Decode(&fieldErrors)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, 1, len(fieldErrors))
+		utils.AssertEqual(t, tc.expectedField, fieldErrors[0].Field)
+		utils.AssertEqual(t, tc.expectedTag, fieldErrors[0].Tag)
+	}
+
+	var usersCount int64
+	err = DB.Model(&User{}).Count(&usersCount).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, int64(1), usersCount)
+}
+
+func TestPostSignupView(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	form := url.Values{}
+	form.Set("name", "test")
+	form.Set("email", "test@test.com")
+	form.Set("password", "password123")
+	csrfToken, csrfCookie := getCSRFToken(t, app)
+	form.Set(CSRFTokenFormField, csrfToken)
+
+	req := httptest.NewRequest(fiber.MethodPost, "/ui/signup", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", fiber.MIMEApplicationForm)
+	req.AddCookie(csrfCookie)
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	var createdUser User
+	err = DB.Where("Email = ?", "test@test.com").First(&createdUser).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "test", createdUser.Name)
+
+	resp, err = app.Test(httptest.NewRequest(fiber.MethodGet, "/ui/signup", nil))
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
 }
 
 func TestGetChat(t *testing.T) {
@@ -653,3 +861,2158 @@ func TestGetChat(t *testing.T) {
 	utils.AssertEqual(t, chat.Name, v.Chat.Name)
 	utils.AssertEqual(t, len(chat.Members), len(v.Chat.Members))
 }
+
+func TestAuthenticatedRoutesRequireLogin(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+
+	apiRoutes := []struct {
+		method, url string
+	}{
+		{fiber.MethodPost, "/api/users"},
+		{fiber.MethodPost, fmt.Sprintf("/api/chats/%d", chat.ID)},
+		{fiber.MethodPost, fmt.Sprintf("/api/users/%d/avatar", user.ID)},
+		{fiber.MethodPost, fmt.Sprintf("/api/chats/%d/users", chat.ID)},
+		{fiber.MethodGet, fmt.Sprintf("/api/chats/%d/messages", chat.ID)},
+		{fiber.MethodPatch, fmt.Sprintf("/api/chats/%d/messages/1", chat.ID)},
+	}
+	for _, route := range apiRoutes {
+		resp, err := app.Test(httptest.NewRequest(route.method, route.url, nil))
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, route.url)
+		utils.AssertEqual(t, fiber.MIMEApplicationJSON, resp.Header.Get("Content-Type"), route.url)
+	}
+
+	uiRoutes := []string{
+		fmt.Sprintf("/ui/chats/%d", chat.ID),
+		fmt.Sprintf("/ui/users/%d/chats", user.ID),
+	}
+	for _, url := range uiRoutes {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, url, nil))
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, fiber.StatusSeeOther, resp.StatusCode, url)
+		utils.AssertEqual(t, "/ui/login", resp.Header.Get("Location"), url)
+	}
+}
+
+func TestUploadUserAvatarOfOtherUser(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+
+	sessionCookie := getLoggedInUserSessionCookie(t, app, users[0])
+
+	req := httptest.NewRequest(fiber.MethodPost, fmt.Sprintf("/api/users/%d/avatar", users[1].ID), nil)
+	req.AddCookie(sessionCookie)
+	req.Header.Set(CSRFTokenHeader, getAPICSRFToken(t, app, sessionCookie))
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode)
+}
+
+func sendJSONRequest(t *testing.T, app *fiber.App, method, url string, data any, cookie *http.Cookie) *http.Response {
+	t.Helper()
+
+	var body io.Reader
+	if data != nil {
+		b, err := json.Marshal(data)
+		utils.AssertEqual(t, nil, err)
+		body = bytes.NewReader(b)
+	}
+
+	req := httptest.NewRequest(method, url, body)
+	req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	if cookie != nil {
+		req.AddCookie(cookie)
+		if !isSafeMethod(method) && strings.HasPrefix(url, "/api") {
+			req.Header.Set(CSRFTokenHeader, getAPICSRFToken(t, app, cookie))
+		}
+	}
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+
+	return resp
+}
+
+func TestCreateChat(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	data := CreateChatRequestSchema{Name: "test chat", IsPrivate: true}
+	resp := sendJSONRequest(t, app, fiber.MethodPost, "/api/chats", data, cookie)
+	utils.AssertEqual(t, fiber.StatusCreated, resp.StatusCode)
+
+	var v struct {
+		Chat Chat
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, data.Name, v.Chat.Name)
+	utils.AssertEqual(t, true, v.Chat.IsPrivate)
+
+	member, err := getChatMember(DB, v.Chat.ID, user.ID)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, ChatRoleOwner, member.Role)
+}
+
+func TestJoinPrivateChat(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	err = DB.Model(&users[1]).Update("IsAdmin", true).Error
+	utils.AssertEqual(t, nil, err)
+
+	chat := Chat{Name: "private chat", IsPrivate: true}
+	err = DB.Create(&chat).Error
+	utils.AssertEqual(t, nil, err)
+
+	url := fmt.Sprintf("/api/chats/%d/users", chat.ID)
+
+	cookie := getLoggedInUserSessionCookie(t, app, users[0])
+	resp := sendJSONRequest(t, app, fiber.MethodPost, url, nil, cookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode)
+
+	adminCookie := getLoggedInUserSessionCookie(t, app, users[1])
+	resp = sendJSONRequest(t, app, fiber.MethodPost, url, nil, adminCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	member, err := getChatMember(DB, chat.ID, users[1].ID)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, ChatRoleMember, member.Role)
+}
+
+func TestAddChatMember(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 4)
+	utils.AssertEqual(t, nil, err)
+	owner, admin, member, invited := users[0], users[1], users[2], users[3]
+
+	chat := Chat{Name: "private chat", IsPrivate: true}
+	err = DB.Create(&chat).Error
+	utils.AssertEqual(t, nil, err)
+	members := []ChatMember{
+		{ChatID: chat.ID, UserID: owner.ID, Role: ChatRoleOwner},
+		{ChatID: chat.ID, UserID: admin.ID, Role: ChatRoleAdmin},
+		{ChatID: chat.ID, UserID: member.ID, Role: ChatRoleMember},
+	}
+	err = DB.Create(&members).Error
+	utils.AssertEqual(t, nil, err)
+
+	url := fmt.Sprintf("/api/chats/%d/users/%d", chat.ID, invited.ID)
+
+	invitedCookie := getLoggedInUserSessionCookie(t, app, invited)
+	resp := sendJSONRequest(t, app, fiber.MethodPost, url, nil, invitedCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "user adds themselves")
+
+	memberCookie := getLoggedInUserSessionCookie(t, app, member)
+	resp = sendJSONRequest(t, app, fiber.MethodPost, url, nil, memberCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "member adds user")
+
+	adminCookie := getLoggedInUserSessionCookie(t, app, admin)
+	missingURL := fmt.Sprintf("/api/chats/%d/users/%d", chat.ID, invited.ID+1000)
+	resp = sendJSONRequest(t, app, fiber.MethodPost, missingURL, nil, adminCookie)
+	utils.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode, "admin adds missing user")
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, url, nil, adminCookie)
+	utils.AssertEqual(t, fiber.StatusCreated, resp.StatusCode, "admin adds user")
+
+	var v struct {
+		Member ChatMember
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, invited.ID, v.Member.UserID)
+	utils.AssertEqual(t, ChatRoleMember, v.Member.Role)
+
+	ownerCookie := getLoggedInUserSessionCookie(t, app, owner)
+	resp = sendJSONRequest(t, app, fiber.MethodPost, url, nil, ownerCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "owner adds existing member")
+
+	// added member can read private chat
+	resp = sendJSONRequest(t, app, fiber.MethodGet, fmt.Sprintf("/api/chats/%d", chat.ID), nil, invitedCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+}
+
+func TestChatRolePermissions(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 3)
+	utils.AssertEqual(t, nil, err)
+	owner, admin, member := users[0], users[1], users[2]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	members := []ChatMember{
+		{ChatID: chat.ID, UserID: owner.ID, Role: ChatRoleOwner},
+		{ChatID: chat.ID, UserID: admin.ID, Role: ChatRoleAdmin},
+		{ChatID: chat.ID, UserID: member.ID, Role: ChatRoleMember},
+	}
+	err = DB.Create(&members).Error
+	utils.AssertEqual(t, nil, err)
+
+	message := Message{ChatID: chat.ID, FromID: owner.ID, Content: "announcement"}
+	err = DB.Create(&message).Error
+	utils.AssertEqual(t, nil, err)
+
+	ownerCookie := getLoggedInUserSessionCookie(t, app, owner)
+	adminCookie := getLoggedInUserSessionCookie(t, app, admin)
+	memberCookie := getLoggedInUserSessionCookie(t, app, member)
+
+	chatURL := fmt.Sprintf("/api/chats/%d", chat.ID)
+	rename := RenameChatRequestSchema{Name: "renamed chat"}
+
+	resp := sendJSONRequest(t, app, fiber.MethodPatch, chatURL, rename, memberCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "member renames chat")
+	resp = sendJSONRequest(t, app, fiber.MethodPatch, chatURL, rename, adminCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "admin renames chat")
+
+	messageURL := fmt.Sprintf("/api/chats/%d/messages/%d", chat.ID, message.ID)
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, messageURL, nil, memberCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "member moderates message")
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, messageURL, nil, adminCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode, "admin moderates message")
+
+	adminURL := fmt.Sprintf("/api/chats/%d/users/%d", chat.ID, admin.ID)
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, adminURL, nil, memberCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "member removes admin")
+
+	roleURL := fmt.Sprintf("/api/chats/%d/users/%d/role", chat.ID, member.ID)
+	role := SetChatMemberRoleRequestSchema{Role: ChatRoleAdmin}
+	resp = sendJSONRequest(t, app, fiber.MethodPut, roleURL, role, adminCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "admin promotes member")
+	resp = sendJSONRequest(t, app, fiber.MethodPut, roleURL, role, ownerCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "owner promotes member")
+
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, adminURL, nil, ownerCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode, "owner removes admin")
+
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, chatURL, nil, memberCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "new admin deletes chat")
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, chatURL, nil, ownerCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode, "owner deletes chat")
+}
+
+func TestBearerTokenAuth(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+
+	tokens := getUserTokens(t, app, *user)
+	utils.AssertEqual(t, "Bearer", tokens.TokenType)
+
+	joinURL := fmt.Sprintf("/api/chats/%d/users", chat.ID)
+
+	req := httptest.NewRequest(fiber.MethodPost, joinURL, nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tokens.AccessToken)
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	req = httptest.NewRequest(fiber.MethodPost, joinURL, nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer invalid-token")
+	resp, err = app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	// bearer tokens are not accepted by UI
+	req = httptest.NewRequest(fiber.MethodGet, fmt.Sprintf("/ui/users/%d/chats", user.ID), nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tokens.AccessToken)
+	resp, err = app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusSeeOther, resp.StatusCode)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	tokens := getUserTokens(t, app, *user)
+
+	refresh := RefreshTokenRequestSchema{RefreshToken: tokens.RefreshToken}
+	resp := sendJSONRequest(t, app, fiber.MethodPost, "/api/token/refresh", refresh, nil)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	var rotatedTokens TokenPair
+	err = json.NewDecoder(resp.Body).Decode(&rotatedTokens)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, true, rotatedTokens.RefreshToken != tokens.RefreshToken)
+
+	// reusing refresh token revokes every token of the login
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/token/refresh", refresh, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	rotatedRefresh := RefreshTokenRequestSchema{RefreshToken: rotatedTokens.RefreshToken}
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/token/refresh", rotatedRefresh, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestRevokeToken(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	tokens := getUserTokens(t, app, *user)
+
+	b, err := json.Marshal(RefreshTokenRequestSchema{RefreshToken: tokens.RefreshToken})
+	utils.AssertEqual(t, nil, err)
+	req := httptest.NewRequest(fiber.MethodPost, "/api/token/revoke", bytes.NewReader(b))
+	req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tokens.AccessToken)
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+
+	req = httptest.NewRequest(fiber.MethodPost, "/api/chats", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tokens.AccessToken)
+	resp, err = app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	refresh := RefreshTokenRequestSchema{RefreshToken: tokens.RefreshToken}
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/token/refresh", refresh, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestLogout(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	resp := sendJSONRequest(t, app, fiber.MethodPost, "/api/logout", nil, cookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+
+	resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, cookie)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestSessions(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	laptopCookie := getLoggedInUserSessionCookie(t, app, *user)
+	phoneCookie := getLoggedInUserSessionCookie(t, app, *user)
+	tabletCookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	getSessions := func(cookie *http.Cookie) []SessionInfo {
+		resp := sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, cookie)
+		utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+		var v struct {
+			Sessions []SessionInfo
+		}
+		err := json.NewDecoder(resp.Body).Decode(&v)
+		utils.AssertEqual(t, nil, err)
+		return v.Sessions
+	}
+
+	sessions := getSessions(laptopCookie)
+	utils.AssertEqual(t, 3, len(sessions))
+	currentSessionsCount := 0
+	for _, s := range sessions {
+		if s.Current {
+			currentSessionsCount += 1
+			utils.AssertEqual(t, laptopCookie.Value, s.ID)
+		}
+	}
+	utils.AssertEqual(t, 1, currentSessionsCount)
+
+	resp := sendJSONRequest(t, app, fiber.MethodDelete, "/api/sessions/"+phoneCookie.Value, nil, laptopCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+
+	resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, phoneCookie)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	utils.AssertEqual(t, 2, len(getSessions(laptopCookie)))
+
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, "/api/sessions", nil, laptopCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+
+	resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, tabletCookie)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	utils.AssertEqual(t, 1, len(getSessions(laptopCookie)))
+
+	// sessions of other users can not be revoked
+	otherUser, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+	otherCookie := getLoggedInUserSessionCookie(t, app, *otherUser)
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, "/api/sessions/"+laptopCookie.Value, nil, otherCookie)
+	utils.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestSessionSavedAfterLoginCanBeRevoked(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	redisDB := getRedis(NewConfig("test_config")).Conn()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	laptopCookie := getLoggedInUserSessionCookie(t, app, *user)
+	phoneCookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	// registry entry of session created long ago is about to expire
+	ctx := context.Background()
+	for _, key := range []string{sessionInfoKey(phoneCookie.Value), userSessionsKey(user.ID)} {
+		err = redisDB.Expire(ctx, key, time.Minute).Err()
+		utils.AssertEqual(t, nil, err)
+	}
+
+	// the first API request creates CSRF token and saves session
+	resp := sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, phoneCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	for _, key := range []string{sessionInfoKey(phoneCookie.Value), userSessionsKey(user.ID)} {
+		ttl, err := redisDB.TTL(ctx, key).Result()
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, true, ttl >= sessionExpiration, key)
+	}
+
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, "/api/sessions", nil, laptopCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+
+	resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, phoneCookie)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestEmailVerification(t *testing.T) {
+	app, DB, outbox, teardownTest := setupTestWithOutbox(t)
+	defer teardownTest()
+
+	data := SignupRequestSchema{
+		Name:     "test",
+		Email:    "test@test.com",
+		Password: "password123",
+	}
+	resp := postSignup(t, app, data)
+	utils.AssertEqual(t, fiber.StatusCreated, resp.StatusCode)
+
+	token := getMailToken(t, outbox, data.Email)
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/ui/verify-email?token="+token, nil))
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	var user User
+	err = DB.Where("Email = ?", data.Email).First(&user).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, true, user.EmailVerifiedAt != nil)
+
+	// tokens are single-use
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/verify-email", VerifyEmailRequestSchema{Token: token}, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestPasswordReset(t *testing.T) {
+	app, DB, outbox, teardownTest := setupTestWithOutbox(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	oldSessionCookie := getLoggedInUserSessionCookie(t, app, *user)
+	oldTokens := getUserTokens(t, app, *user)
+
+	resp := sendJSONRequest(t, app, fiber.MethodPost, "/api/password-reset", RequestPasswordResetRequestSchema{Email: "unknown@test.com"}, nil)
+	utils.AssertEqual(t, fiber.StatusAccepted, resp.StatusCode)
+	utils.AssertEqual(t, 0, len(outbox.Mails()))
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/password-reset", RequestPasswordResetRequestSchema{Email: user.Email}, nil)
+	utils.AssertEqual(t, fiber.StatusAccepted, resp.StatusCode)
+
+	token := getMailToken(t, outbox, user.Email)
+
+	// link points to configured app URL, not to Host header of request
+	mail := outbox.LastMailTo(user.Email)
+	utils.AssertEqual(t, true, strings.Contains(mail.Body, "http://localhost:3000/ui/reset-password?token="), mail.Body)
+
+	weakPassword := ResetPasswordRequestSchema{Token: token, Password: "weak"}
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/password-reset/confirm", weakPassword, nil)
+	utils.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	newPassword := ResetPasswordRequestSchema{Token: token, Password: "new-password-123"}
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/password-reset/confirm", newPassword, nil)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/password-reset/confirm", newPassword, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "token reuse")
+
+	resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, oldSessionCookie)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "old session is revoked")
+
+	refresh := RefreshTokenRequestSchema{RefreshToken: oldTokens.RefreshToken}
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/token/refresh", refresh, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "old refresh token is revoked")
+
+	req := httptest.NewRequest(fiber.MethodGet, "/api/sessions", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+oldTokens.AccessToken)
+	resp, err = app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "old access token is revoked")
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/login", LoginRequestSchema{Email: user.Email, Password: user.Password}, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "login with old password")
+
+	user.Password = newPassword.Password
+	getLoggedInUserSessionCookie(t, app, *user)
+}
+
+// enableTwoFactor enrolls user into two-factor authentication and returns
+// TOTP secret and recovery codes
+func enableTwoFactor(t *testing.T, app *fiber.App, cookie *http.Cookie) (string, []string) {
+	t.Helper()
+
+	resp := sendJSONRequest(t, app, fiber.MethodPost, "/api/2fa/enroll", nil, cookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	var enrollment TwoFactorEnrollment
+	err := json.NewDecoder(resp.Body).Decode(&enrollment)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, true, strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/"))
+	utils.AssertEqual(t, true, strings.HasPrefix(enrollment.QRCode, "data:image/png;base64,"))
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/2fa/confirm", TwoFactorCodeRequestSchema{Code: "000000"}, cookie)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "confirm with invalid code")
+
+	code, err := totp.GenerateCode(enrollment.Secret, time.Now())
+	utils.AssertEqual(t, nil, err)
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/2fa/confirm", TwoFactorCodeRequestSchema{Code: code}, cookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	var v struct {
+		RecoveryCodes []string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, recoveryCodesCount, len(v.RecoveryCodes))
+
+	return enrollment.Secret, v.RecoveryCodes
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	secret, recoveryCodes := enableTwoFactor(t, app, getLoggedInUserSessionCookie(t, app, *user))
+
+	loginData := LoginRequestSchema{Email: user.Email, Password: user.Password}
+	resp := sendJSONRequest(t, app, fiber.MethodPost, "/api/login", loginData, nil)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var v struct {
+		TwoFactorRequired bool
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, true, v.TwoFactorRequired)
+
+	pendingCookie := getSessionCookie(resp)
+	resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, pendingCookie)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "half-authenticated session")
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/login/2fa", TwoFactorCodeRequestSchema{Code: "000000"}, pendingCookie)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "invalid code")
+
+	// code of the next period, as the current one was used for confirmation
+	code, err := totp.GenerateCode(secret, time.Now().Add(30*time.Second))
+	utils.AssertEqual(t, nil, err)
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/login/2fa", TwoFactorCodeRequestSchema{Code: code}, pendingCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, getSessionCookie(resp))
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	loginData.Code = code
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/login", loginData, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "code reuse")
+
+	loginData.Code = recoveryCodes[0]
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/login", loginData, nil)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "recovery code")
+	resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, getSessionCookie(resp))
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/token", loginData, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode, "recovery code reuse")
+
+	// browser logged in as another user is logged out while code is pending
+	otherUser, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+	otherCookie := getLoggedInUserSessionCookie(t, app, *otherUser)
+
+	loginData.Code = ""
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/login", loginData, otherCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	pendingCookie = getSessionCookie(resp)
+
+	for _, cookie := range []*http.Cookie{otherCookie, pendingCookie} {
+		resp = sendJSONRequest(t, app, fiber.MethodGet, "/api/sessions", nil, cookie)
+		utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestSetUserAdminRequiresTwoFactor(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	err = DB.Model(&users[0]).Update("IsAdmin", true).Error
+	utils.AssertEqual(t, nil, err)
+
+	adminCookie := getLoggedInUserSessionCookie(t, app, users[0])
+	url := fmt.Sprintf("/api/users/%d/admin", users[1].ID)
+
+	resp := sendJSONRequest(t, app, fiber.MethodPut, url, SetUserAdminRequestSchema{IsAdmin: true}, adminCookie)
+	utils.AssertEqual(t, fiber.StatusConflict, resp.StatusCode)
+
+	enableTwoFactor(t, app, getLoggedInUserSessionCookie(t, app, users[1]))
+
+	resp = sendJSONRequest(t, app, fiber.MethodPut, url, SetUserAdminRequestSchema{IsAdmin: true}, adminCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+}
+
+func TestLoginLockout(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	user, admin := users[0], users[1]
+	err = DB.Model(&admin).Update("IsAdmin", true).Error
+	utils.AssertEqual(t, nil, err)
+	adminCookie := getLoggedInUserSessionCookie(t, app, admin)
+
+	wrongLogin := LoginRequestSchema{Email: user.Email, Password: "wrong-password-1"}
+	for i := 0; i < maxLoginFailuresPerEmail; i += 1 {
+		resp := sendJSONRequest(t, app, fiber.MethodPost, "/api/login", wrongLogin, nil)
+		utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	}
+
+	login := LoginRequestSchema{Email: user.Email, Password: user.Password}
+	resp := sendJSONRequest(t, app, fiber.MethodPost, "/api/login", login, nil)
+	utils.AssertEqual(t, fiber.StatusTooManyRequests, resp.StatusCode, "locked with right password")
+	utils.AssertEqual(t, "30", resp.Header.Get(fiber.HeaderRetryAfter))
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/token", login, nil)
+	utils.AssertEqual(t, fiber.StatusTooManyRequests, resp.StatusCode, "token endpoint is locked too")
+
+	upperCaseLogin := LoginRequestSchema{Email: strings.ToUpper(user.Email), Password: user.Password}
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/login", upperCaseLogin, nil)
+	utils.AssertEqual(t, fiber.StatusTooManyRequests, resp.StatusCode, "email case")
+
+	url := fmt.Sprintf("/api/users/%d/login-lock", user.ID)
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, url, nil, nil)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, url, nil, adminCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+
+	getLoggedInUserSessionCookie(t, app, user)
+}
+
+func TestCSRFProtection(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	csrfToken, csrfCookie := getCSRFToken(t, app)
+	_, otherCSRFCookie := getCSRFToken(t, app)
+
+	postLogin := func(token string, cookie *http.Cookie) *http.Response {
+		form := url.Values{}
+		form.Set("email", user.Email)
+		form.Set("password", user.Password)
+		form.Set(CSRFTokenFormField, token)
+
+		req := httptest.NewRequest(fiber.MethodPost, "/ui/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", fiber.MIMEApplicationForm)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := app.Test(req)
+		utils.AssertEqual(t, nil, err)
+		return resp
+	}
+
+	resp := postLogin("", csrfCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "no token")
+
+	resp = postLogin(csrfToken, nil)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "no session")
+
+	resp = postLogin(csrfToken, otherCSRFCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "token of other session")
+
+	resp = postLogin(csrfToken, csrfCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	tokens := getUserTokens(t, app, *user)
+	req := httptest.NewRequest(fiber.MethodPost, "/api/logout", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tokens.AccessToken)
+	resp, err = app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode, "API is not covered")
+}
+
+func TestWebsocketRequiresAuth(t *testing.T) {
+	app, _, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	addr := startTestServer(t, app)
+
+	_, resp, err := dialWebsocket(addr, nil)
+	utils.AssertEqual(t, websocket.ErrBadHandshake, err)
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestCrossOriginLiveConnectionsAreRejected(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	addr := startTestServer(t, app)
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	dial := func(origin string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		header.Set("Cookie", fmt.Sprintf("%s=%s", cookie.Name, cookie.Value))
+		header.Set(fiber.HeaderOrigin, origin)
+		return websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", addr), header)
+	}
+
+	_, resp, err := dial("http://evil.example")
+	utils.AssertEqual(t, websocket.ErrBadHandshake, err)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode)
+
+	conn, _, err := dial("http://" + addr)
+	utils.AssertEqual(t, nil, err)
+	conn.Close()
+
+	req, err := http.NewRequest(fiber.MethodGet, fmt.Sprintf("http://%s/sse", addr), nil)
+	utils.AssertEqual(t, nil, err)
+	req.AddCookie(cookie)
+	req.Header.Set(fiber.HeaderOrigin, "http://evil.example")
+	resp, err = http.DefaultClient.Do(req)
+	utils.AssertEqual(t, nil, err)
+	resp.Body.Close()
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode)
+}
+
+func TestWebsocketIgnoresUserIDOfOtherUser(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	receiver, sender := users[0], users[1]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	members := []ChatMember{
+		{ChatID: chat.ID, UserID: receiver.ID, Role: ChatRoleOwner},
+		{ChatID: chat.ID, UserID: sender.ID, Role: ChatRoleMember},
+	}
+	err = DB.Create(&members).Error
+	utils.AssertEqual(t, nil, err)
+
+	addr := startTestServer(t, app)
+
+	receiverConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, receiver))
+	utils.AssertEqual(t, nil, err)
+	defer receiverConn.Close()
+	err = receiverConn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+	})
+	utils.AssertEqual(t, nil, err)
+
+	senderConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, sender))
+	utils.AssertEqual(t, nil, err)
+	defer senderConn.Close()
+
+	// impersonation attempt is ignored, so receiver gets only the second
+	// message and it is sent on behalf of sender
+	err = senderConn.WriteJSON(SendMessageRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "send_message"},
+		ChatID:            chat.ID,
+		UserID:            receiver.ID,
+		Message:           "forged",
+	})
+	utils.AssertEqual(t, nil, err)
+	err = senderConn.WriteJSON(SendMessageRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "send_message"},
+		ChatID:            chat.ID,
+		Message:           "hello",
+	})
+	utils.AssertEqual(t, nil, err)
+
+	err = receiverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	var broadcast BroadcastMessageSchema
+	err = readWebsocketJSON(receiverConn, &broadcast)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "hello", broadcast.Message)
+	utils.AssertEqual(t, sender.Email, broadcast.FromUserEmail)
+
+	var messages []Message
+	err = DB.Where("chat_id = ?", chat.ID).Find(&messages).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, 1, len(messages))
+	utils.AssertEqual(t, sender.ID, messages[0].FromID)
+}
+
+func TestWebsocketConcurrentSends(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	sendersCount := 3
+	messagesPerSender := 5
+
+	users, err := addRandomUsers(DB, sendersCount+1)
+	utils.AssertEqual(t, nil, err)
+	receiver, senders := users[0], users[1:]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	for _, user := range users {
+		err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: user.ID}).Error
+		utils.AssertEqual(t, nil, err)
+	}
+
+	addr := startTestServer(t, app)
+
+	receiverConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, receiver))
+	utils.AssertEqual(t, nil, err)
+	defer receiverConn.Close()
+	err = receiverConn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+	})
+	utils.AssertEqual(t, nil, err)
+
+	senderConns := make([]*websocket.Conn, len(senders))
+	for i, sender := range senders {
+		senderConns[i], _, err = dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, sender))
+		utils.AssertEqual(t, nil, err)
+		defer senderConns[i].Close()
+	}
+
+	// every sender has own connection, so they are handled in parallel and
+	// write to receiver concurrently
+	errs := make(chan error, len(senderConns))
+	for _, conn := range senderConns {
+		go func(conn *websocket.Conn) {
+			for i := 0; i < messagesPerSender; i += 1 {
+				err := conn.WriteJSON(SendMessageRequestSchema{
+					BaseMessageSchema: BaseMessageSchema{Type: "send_message"},
+					ChatID:            chat.ID,
+					Message:           fmt.Sprintf("message %d", i),
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(conn)
+	}
+	for range senderConns {
+		utils.AssertEqual(t, nil, <-errs)
+	}
+
+	err = receiverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	for i := 0; i < sendersCount*messagesPerSender; i += 1 {
+		var broadcast BroadcastMessageSchema
+		err = readWebsocketJSON(receiverConn, &broadcast)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "new_message", broadcast.Type)
+	}
+}
+
+func TestWebsocketMultipleConnectionsPerUser(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	receiver, sender := users[0], users[1]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	for _, user := range users {
+		err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: user.ID}).Error
+		utils.AssertEqual(t, nil, err)
+	}
+
+	addr := startTestServer(t, app)
+
+	// two tabs of one browser and another device. The last one is on another
+	// page, so it is not subscribed to the chat
+	receiverCookie := getLoggedInUserSessionCookie(t, app, receiver)
+	receiverConns := make([]*websocket.Conn, 3)
+	for i, cookie := range []*http.Cookie{receiverCookie, receiverCookie, getLoggedInUserSessionCookie(t, app, receiver)} {
+		receiverConns[i], _, err = dialWebsocket(addr, cookie)
+		utils.AssertEqual(t, nil, err)
+		defer receiverConns[i].Close()
+	}
+	for _, conn := range receiverConns[:2] {
+		err = conn.WriteJSON(SubscribeRequestSchema{
+			BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+			ChatID:            chat.ID,
+		})
+		utils.AssertEqual(t, nil, err)
+	}
+
+	// another tab of sender shows the message too, `replay_done` confirms
+	// that its subscription is active
+	senderCookie := getLoggedInUserSessionCookie(t, app, sender)
+	senderOtherConn, _, err := dialWebsocket(addr, senderCookie)
+	utils.AssertEqual(t, nil, err)
+	defer senderOtherConn.Close()
+	var lastMessageID uint
+	err = senderOtherConn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+		LastMessageID:     &lastMessageID,
+	})
+	utils.AssertEqual(t, nil, err)
+	var replayDone ReplayDoneSchema
+	err = readWebsocketJSON(senderOtherConn, &replayDone)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "replay_done", replayDone.Type)
+
+	senderConn, _, err := dialWebsocket(addr, senderCookie)
+	utils.AssertEqual(t, nil, err)
+	defer senderConn.Close()
+	err = senderConn.WriteJSON(SendMessageRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "send_message"},
+		ChatID:            chat.ID,
+		Message:           "hello",
+	})
+	utils.AssertEqual(t, nil, err)
+
+	// sending connection gets only `ack`
+	err = senderConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	var ack AckSchema
+	err = readWebsocketJSON(senderConn, &ack)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "ack", ack.Type)
+
+	for _, conn := range []*websocket.Conn{receiverConns[0], receiverConns[1], senderOtherConn} {
+		err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		utils.AssertEqual(t, nil, err)
+		var broadcast BroadcastMessageSchema
+		err = readWebsocketJSON(conn, &broadcast)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "new_message", broadcast.Type)
+		utils.AssertEqual(t, "hello", broadcast.Message)
+		utils.AssertEqual(t, chat.ID, broadcast.ChatID)
+		utils.AssertEqual(t, sender.ID, broadcast.FromUserID)
+	}
+
+	err = receiverConns[2].SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	var notification UnreadNotificationSchema
+	err = readWebsocketJSON(receiverConns[2], &notification)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "unread", notification.Type)
+	utils.AssertEqual(t, chat.ID, notification.ChatID)
+}
+
+func TestSendMessageAPIPublishesToWebsocket(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	receiver, sender := users[0], users[1]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	for _, user := range users {
+		err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: user.ID}).Error
+		utils.AssertEqual(t, nil, err)
+	}
+
+	addr := startTestServer(t, app)
+
+	receiverConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, receiver))
+	utils.AssertEqual(t, nil, err)
+	defer receiverConn.Close()
+	err = receiverConn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+	})
+	utils.AssertEqual(t, nil, err)
+
+	url := fmt.Sprintf("/api/chats/%d", chat.ID)
+	resp := sendJSONRequest(t, app, fiber.MethodPost, url, SendMessageRequest{Content: "hello"}, getLoggedInUserSessionCookie(t, app, sender))
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	err = receiverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	var broadcast BroadcastMessageSchema
+	err = readWebsocketJSON(receiverConn, &broadcast)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "hello", broadcast.Message)
+	utils.AssertEqual(t, sender.ID, broadcast.FromUserID)
+}
+
+func TestChatAccessRequiresMembership(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	member, outsider := users[0], users[1]
+
+	privateChat := Chat{Name: "private chat", IsPrivate: true}
+	err = DB.Create(&privateChat).Error
+	utils.AssertEqual(t, nil, err)
+	err = DB.Create(&ChatMember{ChatID: privateChat.ID, UserID: member.ID}).Error
+	utils.AssertEqual(t, nil, err)
+
+	memberCookie := getLoggedInUserSessionCookie(t, app, member)
+	outsiderCookie := getLoggedInUserSessionCookie(t, app, outsider)
+	url := fmt.Sprintf("/api/chats/%d", privateChat.ID)
+
+	resp := sendJSONRequest(t, app, fiber.MethodPost, url, SendMessageRequest{Content: "hello"}, outsiderCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "outsider sends message")
+	resp = sendJSONRequest(t, app, fiber.MethodPost, url, SendMessageRequest{Content: "hello"}, memberCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "member sends message")
+
+	resp, err = app.Test(httptest.NewRequest(fiber.MethodGet, url, nil))
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "anonymous gets private chat")
+	resp = sendJSONRequest(t, app, fiber.MethodGet, url, nil, outsiderCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "outsider gets private chat")
+	resp = sendJSONRequest(t, app, fiber.MethodGet, url, nil, memberCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "member gets private chat")
+}
+
+func TestPrivateChatsAreListedOnlyToMembers(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	member, outsider := users[0], users[1]
+
+	privateChat := Chat{Name: "private chat", IsPrivate: true}
+	publicChat := Chat{Name: "public chat"}
+	for _, chat := range []*Chat{&privateChat, &publicChat} {
+		err = DB.Create(chat).Error
+		utils.AssertEqual(t, nil, err)
+		err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: member.ID}).Error
+		utils.AssertEqual(t, nil, err)
+	}
+
+	memberCookie := getLoggedInUserSessionCookie(t, app, member)
+	outsiderCookie := getLoggedInUserSessionCookie(t, app, outsider)
+
+	getChatIDs := func(cookie *http.Cookie) []uint {
+		t.Helper()
+
+		resp := sendJSONRequest(t, app, fiber.MethodGet, "/api/chats", nil, cookie)
+		utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+		var data GetChatsResponse
+		err := json.NewDecoder(resp.Body).Decode(&data)
+		utils.AssertEqual(t, nil, err)
+		chatIDs := []uint{}
+		for _, chat := range data.Chats {
+			chatIDs = append(chatIDs, chat.ID)
+		}
+		return chatIDs
+	}
+	utils.AssertEqual(t, []uint{privateChat.ID, publicChat.ID}, getChatIDs(memberCookie))
+	utils.AssertEqual(t, []uint{publicChat.ID}, getChatIDs(outsiderCookie))
+	utils.AssertEqual(t, []uint{publicChat.ID}, getChatIDs(nil))
+
+	getUserChatIDs := func(cookie *http.Cookie) []uint {
+		t.Helper()
+
+		resp := sendJSONRequest(t, app, fiber.MethodGet, fmt.Sprintf("/api/users/%d", member.ID), nil, cookie)
+		utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+		var data struct {
+			User User
+		}
+		err := json.NewDecoder(resp.Body).Decode(&data)
+		utils.AssertEqual(t, nil, err)
+		chatIDs := []uint{}
+		for _, chat := range data.User.Chats {
+			chatIDs = append(chatIDs, chat.ID)
+		}
+		return chatIDs
+	}
+	utils.AssertEqual(t, 2, len(getUserChatIDs(memberCookie)))
+	utils.AssertEqual(t, []uint{publicChat.ID}, getUserChatIDs(outsiderCookie))
+
+	for _, url := range []string{"/ui/chats", fmt.Sprintf("/ui/users/%d", member.ID)} {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, url, nil))
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, url)
+		b, err := io.ReadAll(resp.Body)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, true, strings.Contains(string(b), publicChat.Name), url)
+		utils.AssertEqual(t, false, strings.Contains(string(b), privateChat.Name), url)
+	}
+}
+
+func TestWebsocketErrorFrames(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+
+	addr := startTestServer(t, app)
+
+	conn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, *user))
+	utils.AssertEqual(t, nil, err)
+	defer conn.Close()
+
+	readErrorFrame := func() ErrorFrameSchema {
+		err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		utils.AssertEqual(t, nil, err)
+		var errorFrame ErrorFrameSchema
+		err = readWebsocketJSON(conn, &errorFrame)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "error", errorFrame.Type)
+		return errorFrame
+	}
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, WebsocketErrorInvalidFrame, readErrorFrame().Code)
+
+	err = conn.WriteJSON(BaseMessageSchema{Type: "unknown", RequestID: "1"})
+	utils.AssertEqual(t, nil, err)
+	errorFrame := readErrorFrame()
+	utils.AssertEqual(t, WebsocketErrorUnknownType, errorFrame.Code)
+	utils.AssertEqual(t, "1", errorFrame.RequestID)
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte(`{"Type": "subscribe", "RequestID": "2", "ChatID": "abc"}`))
+	utils.AssertEqual(t, nil, err)
+	errorFrame = readErrorFrame()
+	utils.AssertEqual(t, WebsocketErrorInvalidFrame, errorFrame.Code)
+	utils.AssertEqual(t, "2", errorFrame.RequestID)
+
+	err = conn.WriteJSON(SendMessageRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "send_message", RequestID: "3"},
+		ChatID:            chat.ID,
+		Message:           "hello",
+	})
+	utils.AssertEqual(t, nil, err)
+	errorFrame = readErrorFrame()
+	utils.AssertEqual(t, WebsocketErrorForbidden, errorFrame.Code, "not a member")
+	utils.AssertEqual(t, "3", errorFrame.RequestID)
+
+	err = conn.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3})
+	utils.AssertEqual(t, nil, err)
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	_, _, err = conn.ReadMessage()
+	utils.AssertEqual(t, true, websocket.IsCloseError(err, websocket.CloseUnsupportedData))
+}
+
+func TestWebsocketIdempotentSend(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: user.ID}).Error
+	utils.AssertEqual(t, nil, err)
+
+	addr := startTestServer(t, app)
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	// the second send is a retry after reconnect
+	acks := make([]AckSchema, 2)
+	for i := range acks {
+		conn, _, err := dialWebsocket(addr, cookie)
+		utils.AssertEqual(t, nil, err)
+		defer conn.Close()
+
+		err = conn.WriteJSON(SendMessageRequestSchema{
+			BaseMessageSchema: BaseMessageSchema{Type: "send_message", RequestID: fmt.Sprint(i)},
+			ChatID:            chat.ID,
+			Message:           "hello",
+			ClientMessageID:   "client-message-1",
+		})
+		utils.AssertEqual(t, nil, err)
+
+		err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		utils.AssertEqual(t, nil, err)
+		err = readWebsocketJSON(conn, &acks[i])
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "ack", acks[i].Type)
+		utils.AssertEqual(t, fmt.Sprint(i), acks[i].RequestID)
+		utils.AssertEqual(t, "client-message-1", acks[i].ClientMessageID)
+	}
+	utils.AssertEqual(t, acks[0].MessageID, acks[1].MessageID)
+
+	url := fmt.Sprintf("/api/chats/%d", chat.ID)
+	data := SendMessageRequest{Content: "hello", ClientMessageID: "client-message-1"}
+	resp := sendJSONRequest(t, app, fiber.MethodPost, url, data, cookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	var messagesCount int64
+	err = DB.Model(&Message{}).Where("chat_id = ?", chat.ID).Count(&messagesCount).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, int64(1), messagesCount)
+
+	// retry of deleted message is acknowledged, but message stays deleted
+	err = DB.Delete(&Message{}, acks[0].MessageID).Error
+	utils.AssertEqual(t, nil, err)
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, url, data, cookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var v struct {
+		ID        uint
+		IsDeleted bool
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, acks[0].MessageID, v.ID)
+	utils.AssertEqual(t, true, v.IsDeleted)
+}
+
+func TestWebsocketReplayMissedMessages(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+	sender, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	for _, u := range []*User{user, sender} {
+		err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: u.ID}).Error
+		utils.AssertEqual(t, nil, err)
+	}
+
+	messageIDs := make([]uint, 3)
+	for i := range messageIDs {
+		message, _, err := saveMessage(DB, sender.ID, chat.ID, fmt.Sprintf("missed %d", i), "")
+		utils.AssertEqual(t, nil, err)
+		messageIDs[i] = message.ID
+	}
+
+	addr := startTestServer(t, app)
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	conn, _, err := dialWebsocket(addr, cookie)
+	utils.AssertEqual(t, nil, err)
+	defer conn.Close()
+
+	// client has seen the first message before it was disconnected
+	err = conn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe", RequestID: "1"},
+		ChatID:            chat.ID,
+		LastMessageID:     &messageIDs[0],
+	})
+	utils.AssertEqual(t, nil, err)
+
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+
+	for i, messageID := range messageIDs[1:] {
+		var broadcastMessage BroadcastMessageSchema
+		err = readWebsocketJSON(conn, &broadcastMessage)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "new_message", broadcastMessage.Type)
+		utils.AssertEqual(t, messageID, broadcastMessage.MessageID)
+		utils.AssertEqual(t, sender.Email, broadcastMessage.FromUserEmail)
+		utils.AssertEqual(t, fmt.Sprintf("missed %d", i+1), broadcastMessage.Message)
+	}
+
+	var replayDone ReplayDoneSchema
+	err = readWebsocketJSON(conn, &replayDone)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "replay_done", replayDone.Type)
+	utils.AssertEqual(t, "1", replayDone.RequestID)
+	utils.AssertEqual(t, messageIDs[2], replayDone.LastMessageID)
+	utils.AssertEqual(t, false, replayDone.Truncated)
+
+	// live messages resume after replay
+	senderCookie := getLoggedInUserSessionCookie(t, app, *sender)
+	url := fmt.Sprintf("/api/chats/%d", chat.ID)
+	resp := sendJSONRequest(t, app, fiber.MethodPost, url, SendMessageRequest{Content: "live"}, senderCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+
+	var broadcastMessage BroadcastMessageSchema
+	err = readWebsocketJSON(conn, &broadcastMessage)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "new_message", broadcastMessage.Type)
+	utils.AssertEqual(t, "live", broadcastMessage.Message)
+}
+
+func TestWebsocketReplayFromFirstMessage(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: user.ID}).Error
+	utils.AssertEqual(t, nil, err)
+
+	// more messages than fit into one replay page
+	messageIDs := make([]uint, replayPageSize+10)
+	for i := range messageIDs {
+		message, _, err := saveMessage(DB, user.ID, chat.ID, fmt.Sprintf("message %d", i), "")
+		utils.AssertEqual(t, nil, err)
+		messageIDs[i] = message.ID
+	}
+
+	addr := startTestServer(t, app)
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	conn, _, err := dialWebsocket(addr, cookie)
+	utils.AssertEqual(t, nil, err)
+	defer conn.Close()
+
+	// client has not seen any message of chat yet
+	lastMessageID := uint(0)
+	err = conn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+		LastMessageID:     &lastMessageID,
+	})
+	utils.AssertEqual(t, nil, err)
+
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+
+	for i, messageID := range messageIDs {
+		var broadcastMessage BroadcastMessageSchema
+		err = readWebsocketJSON(conn, &broadcastMessage)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "new_message", broadcastMessage.Type)
+		utils.AssertEqual(t, messageID, broadcastMessage.MessageID)
+		utils.AssertEqual(t, fmt.Sprintf("message %d", i), broadcastMessage.Message)
+	}
+
+	var replayDone ReplayDoneSchema
+	err = readWebsocketJSON(conn, &replayDone)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "replay_done", replayDone.Type)
+	utils.AssertEqual(t, messageIDs[len(messageIDs)-1], replayDone.LastMessageID)
+	utils.AssertEqual(t, false, replayDone.Truncated)
+}
+
+func TestWebsocketReplayMessageChanges(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: user.ID}).Error
+	utils.AssertEqual(t, nil, err)
+
+	messages := make([]*Message, 3)
+	for i := range messages {
+		messages[i], _, err = saveMessage(DB, user.ID, chat.ID, fmt.Sprintf("message %d", i), "")
+		utils.AssertEqual(t, nil, err)
+	}
+
+	// client has seen this edit before it was disconnected
+	err = editMessage(DB, messages[2], user.ID, "seen edit")
+	utils.AssertEqual(t, nil, err)
+	changedSince := time.Now()
+
+	err = editMessage(DB, messages[0], user.ID, "missed edit")
+	utils.AssertEqual(t, nil, err)
+	err = DB.Delete(messages[1]).Error
+	utils.AssertEqual(t, nil, err)
+
+	addr := startTestServer(t, app)
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	conn, _, err := dialWebsocket(addr, cookie)
+	utils.AssertEqual(t, nil, err)
+	defer conn.Close()
+
+	err = conn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+		LastMessageID:     &messages[2].ID,
+		ChangedSince:      &changedSince,
+	})
+	utils.AssertEqual(t, nil, err)
+
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+
+	var edited MessageEditedSchema
+	err = readWebsocketJSON(conn, &edited)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "message_edited", edited.Type)
+	utils.AssertEqual(t, messages[0].ID, edited.MessageID)
+	utils.AssertEqual(t, "missed edit", edited.Message)
+
+	var deleted MessageDeletedSchema
+	err = readWebsocketJSON(conn, &deleted)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "message_deleted", deleted.Type)
+	utils.AssertEqual(t, messages[1].ID, deleted.MessageID)
+
+	var replayDone ReplayDoneSchema
+	err = readWebsocketJSON(conn, &replayDone)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "replay_done", replayDone.Type)
+	utils.AssertEqual(t, messages[2].ID, replayDone.LastMessageID)
+	utils.AssertEqual(t, false, replayDone.Truncated)
+	utils.AssertEqual(t, true, replayDone.ReplayedAt.After(changedSince))
+}
+
+func TestWebsocketHeartbeat(t *testing.T) {
+	t.Setenv("WEBSOCKET_IDLE_TIMEOUT", "1s")
+	t.Setenv("WEBSOCKET_PING_INTERVAL", "200ms")
+
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	addr := startTestServer(t, app)
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	// client answering pings stays connected after idle timeout, so its read
+	// only times out on client side
+	alive, _, err := dialWebsocket(addr, cookie)
+	utils.AssertEqual(t, nil, err)
+	defer alive.Close()
+
+	pings := 0
+	alive.SetPingHandler(func(data string) error {
+		pings += 1
+		return alive.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	err = alive.SetReadDeadline(time.Now().Add(2 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	_, _, err = alive.ReadMessage()
+	utils.AssertEqual(t, true, os.IsTimeout(err))
+	utils.AssertEqual(t, true, pings >= 5)
+
+	// client ignoring pings is disconnected by server
+	dead, _, err := dialWebsocket(addr, cookie)
+	utils.AssertEqual(t, nil, err)
+	defer dead.Close()
+
+	dead.SetPingHandler(func(string) error {
+		return nil
+	})
+
+	err = dead.SetReadDeadline(time.Now().Add(3 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	_, _, err = dead.ReadMessage()
+	utils.AssertEqual(t, false, err == nil)
+	utils.AssertEqual(t, false, os.IsTimeout(err))
+}
+
+func TestWebsocketTypingIndicator(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	typist, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+	reader, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	for _, u := range []*User{typist, reader} {
+		err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: u.ID}).Error
+		utils.AssertEqual(t, nil, err)
+	}
+
+	addr := startTestServer(t, app)
+
+	readerConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, *reader))
+	utils.AssertEqual(t, nil, err)
+	defer readerConn.Close()
+
+	// `replay_done` confirms that subscription is active
+	var lastMessageID uint
+	err = readerConn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+		LastMessageID:     &lastMessageID,
+	})
+	utils.AssertEqual(t, nil, err)
+	var replayDone ReplayDoneSchema
+	err = readWebsocketJSON(readerConn, &replayDone)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "replay_done", replayDone.Type)
+
+	typistConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, *typist))
+	utils.AssertEqual(t, nil, err)
+	defer typistConn.Close()
+
+	readTyping := func() TypingSchema {
+		t.Helper()
+
+		var typing TypingSchema
+		err := readerConn.SetReadDeadline(time.Now().Add(typingIndicatorTTL + 2*time.Second))
+		utils.AssertEqual(t, nil, err)
+		err = readWebsocketJSON(readerConn, &typing)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "typing", typing.Type)
+		utils.AssertEqual(t, chat.ID, typing.ChatID)
+		utils.AssertEqual(t, typist.ID, typing.UserID)
+		return typing
+	}
+
+	// the second typing_start is throttled
+	for i := 0; i < 2; i++ {
+		err = typistConn.WriteJSON(TypingRequestSchema{
+			BaseMessageSchema: BaseMessageSchema{Type: "typing_start"},
+			ChatID:            chat.ID,
+		})
+		utils.AssertEqual(t, nil, err)
+	}
+	err = typistConn.WriteJSON(TypingRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "typing_stop"},
+		ChatID:            chat.ID,
+	})
+	utils.AssertEqual(t, nil, err)
+
+	utils.AssertEqual(t, true, readTyping().IsTyping)
+	utils.AssertEqual(t, false, readTyping().IsTyping)
+
+	// indicator expires without typing_stop
+	err = typistConn.WriteJSON(TypingRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "typing_start"},
+		ChatID:            chat.ID,
+	})
+	utils.AssertEqual(t, nil, err)
+
+	startedAt := time.Now()
+	utils.AssertEqual(t, true, readTyping().IsTyping)
+	utils.AssertEqual(t, false, readTyping().IsTyping)
+	utils.AssertEqual(t, true, time.Since(startedAt) >= typingIndicatorTTL-time.Second)
+}
+
+func TestWebsocketPresence(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 3)
+	utils.AssertEqual(t, nil, err)
+	watcher, user, stranger := users[0], users[1], users[2]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	for _, member := range []User{watcher, user} {
+		err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: member.ID}).Error
+		utils.AssertEqual(t, nil, err)
+	}
+
+	addr := startTestServer(t, app)
+
+	getPresence := func(userID uint) Presence {
+		t.Helper()
+
+		resp := sendJSONRequest(t, app, fiber.MethodGet, fmt.Sprintf("/api/users/%d", userID), nil, nil)
+		utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+		var body struct {
+			User User
+		}
+		err := json.NewDecoder(resp.Body).Decode(&body)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, false, body.User.Presence == nil)
+		return *body.User.Presence
+	}
+
+	utils.AssertEqual(t, PresenceOffline, getPresence(user.ID).Status)
+
+	watcherConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, watcher))
+	utils.AssertEqual(t, nil, err)
+	defer watcherConn.Close()
+	strangerConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, stranger))
+	utils.AssertEqual(t, nil, err)
+	defer strangerConn.Close()
+
+	readPresence := func() PresenceSchema {
+		t.Helper()
+
+		var presence PresenceSchema
+		err := watcherConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		utils.AssertEqual(t, nil, err)
+		err = watcherConn.ReadJSON(&presence)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "presence", presence.Type)
+		utils.AssertEqual(t, user.ID, presence.UserID)
+		return presence
+	}
+
+	userConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, user))
+	utils.AssertEqual(t, nil, err)
+
+	utils.AssertEqual(t, PresenceOnline, readPresence().Status)
+	utils.AssertEqual(t, PresenceOnline, getPresence(user.ID).Status)
+
+	err = userConn.Close()
+	utils.AssertEqual(t, nil, err)
+
+	presence := readPresence()
+	utils.AssertEqual(t, PresenceOffline, presence.Status)
+	utils.AssertEqual(t, false, presence.LastSeenAt == nil)
+	utils.AssertEqual(t, PresenceOffline, getPresence(user.ID).Status)
+
+	// presence is sent only to users sharing a chat
+	err = strangerConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	utils.AssertEqual(t, nil, err)
+	_, _, err = strangerConn.ReadMessage()
+	utils.AssertEqual(t, true, os.IsTimeout(err))
+}
+
+func TestReadReceipts(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	reader, sender := users[0], users[1]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	otherChat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	for _, user := range users {
+		err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: user.ID}).Error
+		utils.AssertEqual(t, nil, err)
+	}
+
+	messageIDs := make([]uint, 3)
+	for i := range messageIDs {
+		message, _, err := saveMessage(DB, sender.ID, chat.ID, fmt.Sprintf("message %d", i), "")
+		utils.AssertEqual(t, nil, err)
+		messageIDs[i] = message.ID
+	}
+	otherMessage, _, err := saveMessage(DB, sender.ID, otherChat.ID, "other", "")
+	utils.AssertEqual(t, nil, err)
+
+	addr := startTestServer(t, app)
+	readerCookie := getLoggedInUserSessionCookie(t, app, reader)
+
+	getUnreadCount := func() int64 {
+		t.Helper()
+
+		resp := sendJSONRequest(t, app, fiber.MethodGet, "/api/chats", nil, readerCookie)
+		utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+		var data GetChatsResponse
+		err := json.NewDecoder(resp.Body).Decode(&data)
+		utils.AssertEqual(t, nil, err)
+		for _, c := range data.Chats {
+			if c.ID == otherChat.ID {
+				utils.AssertEqual(t, true, c.UnreadCount == nil, "not a member")
+			}
+			if c.ID == chat.ID {
+				utils.AssertEqual(t, false, c.UnreadCount == nil)
+				return *c.UnreadCount
+			}
+		}
+		t.Fatal("chat not found")
+		return 0
+	}
+
+	getChatsPage := func() string {
+		t.Helper()
+
+		req := httptest.NewRequest(fiber.MethodGet, fmt.Sprintf("/ui/users/%d/chats", reader.ID), nil)
+		req.AddCookie(readerCookie)
+		resp, err := app.Test(req)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		utils.AssertEqual(t, nil, err)
+		return string(b)
+	}
+
+	utils.AssertEqual(t, int64(3), getUnreadCount())
+	utils.AssertEqual(t, true, strings.Contains(getChatsPage(), "3 unread"))
+
+	senderConn, _, err := dialWebsocket(addr, getLoggedInUserSessionCookie(t, app, sender))
+	utils.AssertEqual(t, nil, err)
+	defer senderConn.Close()
+
+	// `replay_done` confirms that subscription is active
+	err = senderConn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+		LastMessageID:     &messageIDs[2],
+	})
+	utils.AssertEqual(t, nil, err)
+	var replayDone ReplayDoneSchema
+	err = readWebsocketJSON(senderConn, &replayDone)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "replay_done", replayDone.Type)
+
+	readReceipt := func() ReadReceiptSchema {
+		t.Helper()
+
+		var receipt ReadReceiptSchema
+		err := senderConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		utils.AssertEqual(t, nil, err)
+		err = readWebsocketJSON(senderConn, &receipt)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "read", receipt.Type)
+		utils.AssertEqual(t, chat.ID, receipt.ChatID)
+		utils.AssertEqual(t, reader.ID, receipt.UserID)
+		return receipt
+	}
+
+	url := fmt.Sprintf("/api/chats/%d/read", chat.ID)
+	resp := sendJSONRequest(t, app, fiber.MethodPost, url, MarkChatReadRequest{MessageID: otherMessage.ID}, readerCookie)
+	utils.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode, "message of another chat")
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, url, MarkChatReadRequest{MessageID: messageIDs[1]}, readerCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+	utils.AssertEqual(t, messageIDs[1], readReceipt().MessageID)
+	utils.AssertEqual(t, int64(1), getUnreadCount())
+
+	readerConn, _, err := dialWebsocket(addr, readerCookie)
+	utils.AssertEqual(t, nil, err)
+	defer readerConn.Close()
+
+	// reading older message does not move last read message back
+	for _, messageID := range []uint{messageIDs[0], messageIDs[2]} {
+		err = readerConn.WriteJSON(MarkReadRequestSchema{
+			BaseMessageSchema: BaseMessageSchema{Type: "mark_read"},
+			ChatID:            chat.ID,
+			MessageID:         messageID,
+		})
+		utils.AssertEqual(t, nil, err)
+	}
+	utils.AssertEqual(t, messageIDs[2], readReceipt().MessageID)
+	utils.AssertEqual(t, int64(0), getUnreadCount())
+	utils.AssertEqual(t, false, strings.Contains(getChatsPage(), " unread"), "no badge when everything is read")
+
+	// deleted message is still a valid read cursor
+	deletedMessage, _, err := saveMessage(DB, sender.ID, chat.ID, "deleted", "")
+	utils.AssertEqual(t, nil, err)
+	err = DB.Delete(deletedMessage).Error
+	utils.AssertEqual(t, nil, err)
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, url, MarkChatReadRequest{MessageID: deletedMessage.ID}, readerCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode)
+	utils.AssertEqual(t, deletedMessage.ID, readReceipt().MessageID)
+}
+
+func TestSSEStream(t *testing.T) {
+	// stream ends on the next ping once client goes away
+	t.Setenv("WEBSOCKET_PING_INTERVAL", "200ms")
+
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 2)
+	utils.AssertEqual(t, nil, err)
+	receiver, sender := users[0], users[1]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	otherChat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	secondChat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	for _, user := range users {
+		for _, chatID := range []uint{chat.ID, secondChat.ID} {
+			err = DB.Create(&ChatMember{ChatID: chatID, UserID: user.ID}).Error
+			utils.AssertEqual(t, nil, err)
+		}
+	}
+
+	// missed message of second chat has lower ID than seen messages of chat
+	seenMessage, _, err := saveMessage(DB, sender.ID, secondChat.ID, "seen", "")
+	utils.AssertEqual(t, nil, err)
+	missedMessage, _, err := saveMessage(DB, sender.ID, secondChat.ID, "missed in second chat", "")
+	utils.AssertEqual(t, nil, err)
+
+	messageIDs := make([]uint, 3)
+	for i := range messageIDs {
+		message, _, err := saveMessage(DB, sender.ID, chat.ID, fmt.Sprintf("missed %d", i), "")
+		utils.AssertEqual(t, nil, err)
+		messageIDs[i] = message.ID
+	}
+
+	addr := startTestServer(t, app)
+	receiverCookie := getLoggedInUserSessionCookie(t, app, receiver)
+
+	openStream := func(query string, lastEventID string, cookie *http.Cookie) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(fiber.MethodGet, fmt.Sprintf("http://%s/sse?%s", addr, query), nil)
+		utils.AssertEqual(t, nil, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		utils.AssertEqual(t, nil, err)
+		return resp
+	}
+
+	resp := openStream(fmt.Sprintf("chatID=%d", chat.ID), "", nil)
+	resp.Body.Close()
+	utils.AssertEqual(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	resp = openStream(fmt.Sprintf("chatID=%d", otherChat.ID), "", receiverCookie)
+	resp.Body.Close()
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "not a member")
+
+	resp = openStream(fmt.Sprintf("chatID=%d", chat.ID), fmt.Sprint(messageIDs[0]), receiverCookie)
+	resp.Body.Close()
+	utils.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode, "cursor without chat")
+
+	query := fmt.Sprintf("chatID=%d&chatID=%d", chat.ID, secondChat.ID)
+	lastEventID := fmt.Sprintf("%d:%d,%d:%d", chat.ID, messageIDs[0], secondChat.ID, seenMessage.ID)
+	resp = openStream(query, lastEventID, receiverCookie)
+	defer resp.Body.Close()
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	utils.AssertEqual(t, "text/event-stream", resp.Header.Get(fiber.HeaderContentType))
+
+	type event struct {
+		ID   string
+		Data []byte
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	readEvent := func() event {
+		t.Helper()
+
+		var e event
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" && e.Data != nil {
+				return e
+			}
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				e.ID = id
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				e.Data = []byte(data)
+			}
+		}
+		t.Fatal("stream ended", scanner.Err())
+		return e
+	}
+
+	// missed messages are replayed with cursors of every chat as event IDs
+	readReplay := func(chatID uint, messageIDs []uint, eventIDs []string) {
+		t.Helper()
+
+		for i, messageID := range messageIDs {
+			e := readEvent()
+			utils.AssertEqual(t, eventIDs[i], e.ID)
+			var broadcast BroadcastMessageSchema
+			err := json.Unmarshal(e.Data, &broadcast)
+			utils.AssertEqual(t, nil, err)
+			utils.AssertEqual(t, "new_message", broadcast.Type)
+			utils.AssertEqual(t, chatID, broadcast.ChatID)
+			utils.AssertEqual(t, messageID, broadcast.MessageID)
+		}
+
+		var replayDone ReplayDoneSchema
+		err := json.Unmarshal(readEvent().Data, &replayDone)
+		utils.AssertEqual(t, nil, err)
+		utils.AssertEqual(t, "replay_done", replayDone.Type)
+		utils.AssertEqual(t, chatID, replayDone.ChatID)
+		utils.AssertEqual(t, messageIDs[len(messageIDs)-1], replayDone.LastMessageID)
+	}
+	readReplay(chat.ID, messageIDs[1:], []string{
+		fmt.Sprintf("%d:%d,%d:%d", chat.ID, messageIDs[1], secondChat.ID, seenMessage.ID),
+		fmt.Sprintf("%d:%d,%d:%d", chat.ID, messageIDs[2], secondChat.ID, seenMessage.ID),
+	})
+	readReplay(secondChat.ID, []uint{missedMessage.ID}, []string{
+		fmt.Sprintf("%d:%d,%d:%d", chat.ID, messageIDs[2], secondChat.ID, missedMessage.ID),
+	})
+
+	url := fmt.Sprintf("/api/chats/%d", chat.ID)
+	sendResp := sendJSONRequest(t, app, fiber.MethodPost, url, SendMessageRequest{Content: "live"}, getLoggedInUserSessionCookie(t, app, sender))
+	utils.AssertEqual(t, fiber.StatusOK, sendResp.StatusCode)
+
+	var broadcast BroadcastMessageSchema
+	err = json.Unmarshal(readEvent().Data, &broadcast)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "new_message", broadcast.Type)
+	utils.AssertEqual(t, "live", broadcast.Message)
+}
+
+func TestGetChatMessagesPagination(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	err = DB.Create(&ChatMember{ChatID: chat.ID, UserID: user.ID}).Error
+	utils.AssertEqual(t, nil, err)
+
+	messageIDs := make([]uint, 5)
+	for i := range messageIDs {
+		message, _, err := saveMessage(DB, user.ID, chat.ID, fmt.Sprintf("message %d", i), "")
+		utils.AssertEqual(t, nil, err)
+		messageIDs[i] = message.ID
+	}
+
+	testCases := []struct {
+		query    string
+		expected []uint
+		hasMore  bool
+	}{
+		{"limit=2", messageIDs[3:], true},
+		{fmt.Sprintf("limit=2&before=%d", messageIDs[3]), messageIDs[1:3], true},
+		{fmt.Sprintf("limit=2&before=%d", messageIDs[1]), messageIDs[:1], false},
+		{fmt.Sprintf("limit=2&after=%d", messageIDs[1]), messageIDs[2:4], true},
+		{fmt.Sprintf("after=%d&before=%d", messageIDs[1], messageIDs[3]), messageIDs[2:3], false},
+		{"", messageIDs, false},
+	}
+	for _, tc := range testCases {
+		url := fmt.Sprintf("/api/chats/%d/messages?%s", chat.ID, tc.query)
+		resp := sendJSONRequest(t, app, fiber.MethodGet, url, nil, cookie)
+		utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, tc.query)
+
+		var data GetChatMessagesResponse
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		utils.AssertEqual(t, nil, err)
+
+		ids := make([]uint, len(data.Messages))
+		for i, message := range data.Messages {
+			ids[i] = message.ID
+		}
+		utils.AssertEqual(t, tc.expected, ids, tc.query)
+		utils.AssertEqual(t, tc.hasMore, data.HasMore, tc.query)
+	}
+
+	url := fmt.Sprintf("/api/chats/%d/messages?limit=1000", chat.ID)
+	resp := sendJSONRequest(t, app, fiber.MethodGet, url, nil, cookie)
+	utils.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	privateChat := Chat{Name: "private chat", IsPrivate: true}
+	err = DB.Create(&privateChat).Error
+	utils.AssertEqual(t, nil, err)
+
+	url = fmt.Sprintf("/api/chats/%d/messages", privateChat.ID)
+	resp = sendJSONRequest(t, app, fiber.MethodGet, url, nil, cookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "not a member of private chat")
+}
+
+func TestEditAndDeleteChatMessage(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	users, err := addRandomUsers(DB, 3)
+	utils.AssertEqual(t, nil, err)
+	author, admin, member := users[0], users[1], users[2]
+
+	chat, err := addRandomChatWithNoUsers(DB)
+	utils.AssertEqual(t, nil, err)
+	members := []ChatMember{
+		{ChatID: chat.ID, UserID: author.ID, Role: ChatRoleMember},
+		{ChatID: chat.ID, UserID: admin.ID, Role: ChatRoleAdmin},
+		{ChatID: chat.ID, UserID: member.ID, Role: ChatRoleMember},
+	}
+	err = DB.Create(&members).Error
+	utils.AssertEqual(t, nil, err)
+
+	message, _, err := saveMessage(DB, author.ID, chat.ID, "helo", "")
+	utils.AssertEqual(t, nil, err)
+
+	addr := startTestServer(t, app)
+	authorCookie := getLoggedInUserSessionCookie(t, app, author)
+	adminCookie := getLoggedInUserSessionCookie(t, app, admin)
+	memberCookie := getLoggedInUserSessionCookie(t, app, member)
+
+	memberConn, _, err := dialWebsocket(addr, memberCookie)
+	utils.AssertEqual(t, nil, err)
+	defer memberConn.Close()
+
+	// `replay_done` confirms that subscription is active
+	err = memberConn.WriteJSON(SubscribeRequestSchema{
+		BaseMessageSchema: BaseMessageSchema{Type: "subscribe"},
+		ChatID:            chat.ID,
+		LastMessageID:     &message.ID,
+	})
+	utils.AssertEqual(t, nil, err)
+	var replayDone ReplayDoneSchema
+	err = readWebsocketJSON(memberConn, &replayDone)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "replay_done", replayDone.Type)
+
+	messageURL := fmt.Sprintf("/api/chats/%d/messages/%d", chat.ID, message.ID)
+
+	resp := sendJSONRequest(t, app, fiber.MethodPatch, messageURL, EditChatMessageRequest{Content: "spam"}, memberCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "member edits message of other user")
+	resp = sendJSONRequest(t, app, fiber.MethodPatch, messageURL, EditChatMessageRequest{}, authorCookie)
+	utils.AssertEqual(t, fiber.StatusBadRequest, resp.StatusCode, "empty content")
+
+	resp = sendJSONRequest(t, app, fiber.MethodPatch, messageURL, EditChatMessageRequest{Content: "hello"}, authorCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var editedMessage Message
+	err = json.NewDecoder(resp.Body).Decode(&editedMessage)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "hello", editedMessage.Content)
+	utils.AssertEqual(t, false, editedMessage.EditedAt == nil)
+
+	err = memberConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	utils.AssertEqual(t, nil, err)
+	var edited MessageEditedSchema
+	err = readWebsocketJSON(memberConn, &edited)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "message_edited", edited.Type)
+	utils.AssertEqual(t, message.ID, edited.MessageID)
+	utils.AssertEqual(t, "hello", edited.Message)
+
+	var revisions []MessageRevision
+	err = DB.Where("message_id = ?", message.ID).Find(&revisions).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, 1, len(revisions))
+	utils.AssertEqual(t, "helo", revisions[0].Content)
+	utils.AssertEqual(t, author.ID, revisions[0].EditedByID)
+
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, messageURL, nil, memberCookie)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "member deletes message of other user")
+	resp = sendJSONRequest(t, app, fiber.MethodDelete, messageURL, nil, adminCookie)
+	utils.AssertEqual(t, fiber.StatusNoContent, resp.StatusCode, "admin deletes message")
+
+	var deleted MessageDeletedSchema
+	err = readWebsocketJSON(memberConn, &deleted)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, "message_deleted", deleted.Type)
+	utils.AssertEqual(t, message.ID, deleted.MessageID)
+
+	resp = sendJSONRequest(t, app, fiber.MethodPatch, messageURL, EditChatMessageRequest{Content: "again"}, authorCookie)
+	utils.AssertEqual(t, fiber.StatusNotFound, resp.StatusCode, "edit of deleted message")
+
+	// deleted message stays in history as placeholder without content
+	url := fmt.Sprintf("/api/chats/%d/messages", chat.ID)
+	resp = sendJSONRequest(t, app, fiber.MethodGet, url, nil, memberCookie)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode)
+	var data GetChatMessagesResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, 1, len(data.Messages))
+	utils.AssertEqual(t, true, data.Messages[0].DeletedAt.Valid)
+	utils.AssertEqual(t, "", data.Messages[0].Content)
+}
+
+func TestMigratePlaintextPasswords(t *testing.T) {
+	_, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	err := DB.Exec("ALTER TABLE users ADD COLUMN password text").Error
+	utils.AssertEqual(t, nil, err)
+
+	user := User{Name: "old user", Email: "old-user@example.com"}
+	err = DB.Create(&user).Error
+	utils.AssertEqual(t, nil, err)
+	err = DB.Table("users").Where("id = ?", user.ID).Update("password", "old-password").Error
+	utils.AssertEqual(t, nil, err)
+
+	err = migratePlaintextPasswords(DB)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, false, DB.Migrator().HasColumn("users", "password"))
+
+	var migratedUser User
+	err = DB.First(&migratedUser, user.ID).Error
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, true, verifyPassword(migratedUser.PasswordHash, "old-password"))
+}
+
+func TestAPICSRFProtection(t *testing.T) {
+	app, DB, teardownTest := setupTest(t)
+	defer teardownTest()
+
+	user, err := addRandomUser(DB, false)
+	utils.AssertEqual(t, nil, err)
+
+	data := CreateChatRequestSchema{Name: "test chat"}
+	b, err := json.Marshal(data)
+	utils.AssertEqual(t, nil, err)
+
+	cookie := getLoggedInUserSessionCookie(t, app, *user)
+	req := httptest.NewRequest(fiber.MethodPost, "/api/chats", bytes.NewReader(b))
+	req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	req.AddCookie(cookie)
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusForbidden, resp.StatusCode, "cookie without CSRF token")
+
+	resp = sendJSONRequest(t, app, fiber.MethodPost, "/api/chats", data, cookie)
+	utils.AssertEqual(t, fiber.StatusCreated, resp.StatusCode, "cookie with CSRF token")
+
+	// bearer tokens are not sent by browsers by themselves
+	tokens := getUserTokens(t, app, *user)
+	b, err = json.Marshal(CreateChatRequestSchema{Name: "bearer chat"})
+	utils.AssertEqual(t, nil, err)
+	req = httptest.NewRequest(fiber.MethodPost, "/api/chats", bytes.NewReader(b))
+	req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tokens.AccessToken)
+	resp, err = app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusCreated, resp.StatusCode, "bearer without CSRF token")
+}
@@ -6,6 +6,14 @@ import (
 )
 
 func handleValidationError(c *fiber.Ctx, err error) error {
+	return handleFieldErrors(c, getFieldErrors(err))
+}
+
+func handleFieldErrors(c *fiber.Ctx, fieldErrors []FieldError) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fieldErrors)
+}
+
+func getFieldErrors(err error) []FieldError {
 	var errors []FieldError
 	for _, err := range err.(validator.ValidationErrors) {
 		el := FieldError{
@@ -15,5 +23,5 @@ func handleValidationError(c *fiber.Ctx, err error) error {
 		}
 		errors = append(errors, el)
 	}
-	return c.Status(fiber.StatusBadRequest).JSON(errors)
+	return errors
 }
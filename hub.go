@@ -0,0 +1,352 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
+)
+
+const websocketSendQueueSize = 64
+const websocketWriteWait = 10 * time.Second
+const defaultWebsocketIdleTimeout = 60 * time.Second
+
+// WebsocketTimeouts are read from `WEBSOCKET_IDLE_TIMEOUT` and
+// `WEBSOCKET_PING_INTERVAL`. Server pings every connection each PingInterval,
+// connection that sends nothing, not even pong, for IdleTimeout is closed
+type WebsocketTimeouts struct {
+	PingInterval time.Duration
+	IdleTimeout  time.Duration
+}
+
+func getWebsocketTimeouts(config *Config) WebsocketTimeouts {
+	timeouts := WebsocketTimeouts{
+		IdleTimeout:  config.GetDuration("WEBSOCKET_IDLE_TIMEOUT"),
+		PingInterval: config.GetDuration("WEBSOCKET_PING_INTERVAL"),
+	}
+	if timeouts.IdleTimeout <= 0 {
+		timeouts.IdleTimeout = defaultWebsocketIdleTimeout
+	}
+	// pong to the last ping must arrive before connection is considered idle
+	if timeouts.PingInterval <= 0 || timeouts.PingInterval >= timeouts.IdleTimeout {
+		timeouts.PingInterval = timeouts.IdleTimeout * 9 / 10
+	}
+	return timeouts
+}
+
+// clientConn is transport of `Client`, websocket or server-sent events stream
+type clientConn interface {
+	// WriteMessage and WritePing are called by writer goroutine only
+	WriteMessage(message []byte) error
+	WritePing() error
+	// WriteClose tells client why connection is closed, if transport can
+	WriteClose(closeCode int, reason string) error
+	Close() error
+}
+
+// Client is connection registered in `Hub`. Connection is written only by its
+// writer goroutine, other goroutines put messages into send queue. User can
+// have many clients, e.g. several browser tabs and a phone
+type Client struct {
+	// id is unique, it identifies connection in presence of user
+	id        string
+	conn      clientConn
+	userID    uint
+	sessionID string
+	timeouts  WebsocketTimeouts
+
+	// chats client is subscribed to, guarded by `Hub.mu`
+	chats map[uint]*chatSubscription
+
+	typing *typingIndicators
+
+	send chan []byte
+	// closed is closed once client is unregistered, after that nothing is
+	// put into send queue
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(id string, conn clientConn, userID uint, sessionID string, timeouts WebsocketTimeouts) *Client {
+	return &Client{
+		id:        id,
+		conn:      conn,
+		userID:    userID,
+		sessionID: sessionID,
+		timeouts:  timeouts,
+		chats:     map[uint]*chatSubscription{},
+		typing:    newTypingIndicators(),
+		send:      make(chan []byte, websocketSendQueueSize),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Send queues message for client. Client which can not keep up with its queue
+// is closed, so that one slow reader does not block everyone else
+func (c *Client) Send(message []byte) {
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	select {
+	case c.send <- message:
+	default:
+		log.Warnf("send queue of client is full userID=%d\n", c.userID)
+		c.close()
+	}
+}
+
+// SendWait queues message for client, waiting for free space in the queue.
+// It is used for replay, which sends more messages at once than queue holds
+func (c *Client) SendWait(message []byte) error {
+	select {
+	case c.send <- message:
+		return nil
+	case <-c.closed:
+		return errors.New("client is closed")
+	}
+}
+
+// writePump writes queued messages and periodic pings to connection until
+// client is closed. It must be the only goroutine writing data messages to
+// connection
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.timeouts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message := <-c.send:
+			err := c.conn.WriteMessage(message)
+			if err != nil {
+				log.Infof("write message err=%s\n", err)
+				c.close()
+				return
+			}
+
+		case <-ticker.C:
+			err := c.conn.WritePing()
+			if err != nil {
+				log.Infof("write ping err=%s\n", err)
+				c.close()
+				return
+			}
+
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// closeWithMessage sends close frame with reason and closes connection
+func (c *Client) closeWithMessage(closeCode int, reason string) {
+	err := c.conn.WriteClose(closeCode, reason)
+	if err != nil {
+		log.Infof("write close message err=%s\n", err)
+	}
+	c.close()
+}
+
+// close stops writer and closes connection, which also stops read loop of
+// `WebsocketHandler` and stream of `SSEHandler`
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// chatSubscription holds live messages of chat while missed messages are
+// replayed to client, so that they are sent after replayed ones
+type chatSubscription struct {
+	isReplaying bool
+	pending     []ChatEvent
+}
+
+// Hub owns registration of websocket clients. Clients are looked up by user
+// and by session they were opened with
+type Hub struct {
+	mu       sync.RWMutex
+	users    map[uint]map[*Client]struct{}
+	sessions map[string]map[*Client]struct{}
+
+	timeouts WebsocketTimeouts
+}
+
+func NewHub(timeouts WebsocketTimeouts) *Hub {
+	return &Hub{
+		users:    map[uint]map[*Client]struct{}{},
+		sessions: map[string]map[*Client]struct{}{},
+		timeouts: timeouts,
+	}
+}
+
+// Register adds client to clients of its user and its session
+func (h *Hub) Register(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	addClient(h.users, client.userID, client)
+	if client.sessionID != "" {
+		addClient(h.sessions, client.sessionID, client)
+	}
+}
+
+// Unregister removes client from hub and closes it
+func (h *Hub) Unregister(client *Client) {
+	h.mu.Lock()
+	removeClient(h.users, client.userID, client)
+	removeClient(h.sessions, client.sessionID, client)
+	h.mu.Unlock()
+
+	client.close()
+}
+
+// Subscribe makes client receive messages of chat
+func (h *Hub) Subscribe(client *Client, chatID uint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	client.chats[chatID] = &chatSubscription{}
+}
+
+// StartReplay subscribes client to chat, but holds live messages of the chat
+// until `FinishReplay` is called
+func (h *Hub) StartReplay(client *Client, chatID uint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	client.chats[chatID] = &chatSubscription{
+		isReplaying: true,
+	}
+}
+
+// FinishReplay sends live messages held during replay, except ones with ID
+// up to lastReplayedMessageID, as client already got them from replay. Held
+// messages may not fit into send queue filled by replay, so they are sent
+// waiting for writer without the lock, and messages arriving meanwhile are
+// held until none are left
+func (h *Hub) FinishReplay(client *Client, chatID uint, lastReplayedMessageID uint) {
+	for {
+		h.mu.Lock()
+		subscription := client.chats[chatID]
+		if subscription == nil || !subscription.isReplaying {
+			h.mu.Unlock()
+			return
+		}
+		pending := subscription.pending
+		subscription.pending = nil
+		if len(pending) == 0 {
+			subscription.isReplaying = false
+			h.mu.Unlock()
+			return
+		}
+		h.mu.Unlock()
+
+		for _, event := range pending {
+			if event.MessageID != 0 && event.MessageID <= lastReplayedMessageID {
+				continue
+			}
+
+			err := client.SendWait(event.Message)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *Hub) Unsubscribe(client *Client, chatID uint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(client.chats, chatID)
+}
+
+// SendToUserInChat queues message for clients of user subscribed to chat and
+// notification, if it is not empty, for the rest of them. Message of event
+// without chat is queued for every client of user. It returns number of
+// clients of user
+func (h *Hub) SendToUserInChat(userID uint, event ChatEvent) int {
+	// exclusive lock keeps order of messages with `FinishReplay`, sending does
+	// not block as it only puts message into queue
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.users[userID] {
+		if event.SkipClientID != "" && client.id == event.SkipClientID {
+			continue
+		}
+
+		if event.ChatID == 0 {
+			client.Send(event.Message)
+			continue
+		}
+
+		subscription := client.chats[event.ChatID]
+		if subscription == nil {
+			if len(event.Notification) > 0 {
+				client.Send(event.Notification)
+			}
+			continue
+		}
+
+		if subscription.isReplaying {
+			if len(subscription.pending) >= maxReplayMessages {
+				log.Warnf("too many messages held during replay userID=%d\n", client.userID)
+				client.close()
+				continue
+			}
+			subscription.pending = append(subscription.pending, event)
+			continue
+		}
+
+		client.Send(event.Message)
+	}
+	return len(h.users[userID])
+}
+
+// Deliver sends event published by `Broker` to local clients of its users
+func (h *Hub) Deliver(event ChatEvent) {
+	if event.CloseSessionID != "" {
+		h.CloseSession(event.CloseSessionID)
+		return
+	}
+
+	for _, userID := range event.UserIDs {
+		h.SendToUserInChat(userID, event)
+	}
+}
+
+// CloseSession closes websocket connections opened with session
+func (h *Hub) CloseSession(sessionID string) {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.sessions[sessionID]))
+	for client := range h.sessions[sessionID] {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.closeWithMessage(websocket.ClosePolicyViolation, "session revoked")
+	}
+}
+
+func addClient[K comparable](index map[K]map[*Client]struct{}, key K, client *Client) {
+	if index[key] == nil {
+		index[key] = map[*Client]struct{}{}
+	}
+	index[key][client] = struct{}{}
+}
+
+func removeClient[K comparable](index map[K]map[*Client]struct{}, key K, client *Client) {
+	clients := index[key]
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(index, key)
+	}
+}
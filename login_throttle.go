@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
+	goredis "github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const loginFailuresWindow = 15 * time.Minute
+const loginLockBaseDuration = 30 * time.Second
+const loginLockMaxDuration = time.Hour
+
+// failed attempts allowed before the first lock. IP limit is higher, as many
+// users can share an IP
+const maxLoginFailuresPerEmail = 5
+const maxLoginFailuresPerIP = 20
+
+// LoginThrottle counts failed login attempts per email and per IP. After too
+// many failures further attempts are locked, and every next failure doubles
+// lock duration
+type LoginThrottle struct {
+	redis goredis.UniversalClient
+}
+
+func NewLoginThrottle(redisClient goredis.UniversalClient) *LoginThrottle {
+	return &LoginThrottle{
+		redis: redisClient,
+	}
+}
+
+// Check returns `TooManyLoginAttemptsError` if email or ip is locked
+func (t *LoginThrottle) Check(ctx context.Context, email, ip string) error {
+	for _, key := range []string{loginLockKey("email", normalizeEmail(email)), loginLockKey("ip", ip)} {
+		ttl, err := t.redis.PTTL(ctx, key).Result()
+		if err != nil {
+			return errors.Wrap(err, "redis get login lock")
+		}
+		if ttl > 0 {
+			return &TooManyLoginAttemptsError{RetryAfter: ttl}
+		}
+	}
+
+	return nil
+}
+
+func (t *LoginThrottle) RegisterFailure(ctx context.Context, email, ip string) error {
+	err := t.registerFailure(ctx, "email", normalizeEmail(email), maxLoginFailuresPerEmail)
+	if err != nil {
+		return err
+	}
+
+	return t.registerFailure(ctx, "ip", ip, maxLoginFailuresPerIP)
+}
+
+func (t *LoginThrottle) registerFailure(ctx context.Context, kind, value string, maxFailures int64) error {
+	failuresKey := loginFailuresKey(kind, value)
+
+	pipe := t.redis.TxPipeline()
+	incr := pipe.Incr(ctx, failuresKey)
+	pipe.Expire(ctx, failuresKey, loginFailuresWindow)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "redis count login failure")
+	}
+
+	failures := incr.Val()
+	if failures < maxFailures {
+		return nil
+	}
+
+	lockDuration := loginLockBaseDuration * time.Duration(math.Pow(2, float64(failures-maxFailures)))
+	if lockDuration <= 0 || lockDuration > loginLockMaxDuration {
+		lockDuration = loginLockMaxDuration
+	}
+
+	// failures are kept while account is locked, so the next lock is longer
+	pipe = t.redis.TxPipeline()
+	pipe.Set(ctx, loginLockKey(kind, value), 1, lockDuration)
+	pipe.Expire(ctx, failuresKey, lockDuration+loginFailuresWindow)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "redis lock login")
+	}
+
+	return nil
+}
+
+// RegisterSuccess resets failures of email. Failures of IP are kept, so that
+// attacker can not reset them by logging into own account
+func (t *LoginThrottle) RegisterSuccess(ctx context.Context, email string) error {
+	return t.Unlock(ctx, email)
+}
+
+// Unlock removes lock and failures of email
+func (t *LoginThrottle) Unlock(ctx context.Context, email string) error {
+	email = normalizeEmail(email)
+	err := t.redis.Del(ctx, loginFailuresKey("email", email), loginLockKey("email", email)).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis delete login lock")
+	}
+	return nil
+}
+
+// authenticateLogin is `authenticateUser` guarded by `LoginThrottle`
+func authenticateLogin(c *fiber.Ctx, db *gorm.DB, email, password string) (*User, error) {
+	throttle, ok := c.Locals("loginThrottle").(*LoginThrottle)
+	if !ok {
+		log.Fatal("error getting `loginThrottle` from c.Locals()")
+	}
+
+	err := checkLoginThrottle(c, throttle, email)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := authenticateUser(db, email, password)
+	if err != nil {
+		var invalidCredentialsError *InvalidCredentialsError
+		if errors.As(err, &invalidCredentialsError) {
+			registerErr := throttle.RegisterFailure(c.Context(), email, c.IP())
+			if registerErr != nil {
+				return nil, registerErr
+			}
+		}
+		return nil, err
+	}
+
+	// password is right, but second factor may still fail, so failures are
+	// reset only when user is fully authenticated
+	if !user.TOTPEnabled {
+		err = throttle.RegisterSuccess(c.Context(), email)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// checkLoginThrottle returns `TooManyLoginAttemptsError` and sets
+// `Retry-After` header if login is locked
+func checkLoginThrottle(c *fiber.Ctx, throttle *LoginThrottle, email string) error {
+	err := throttle.Check(c.Context(), email, c.IP())
+	if err != nil {
+		var tooManyLoginAttemptsError *TooManyLoginAttemptsError
+		if errors.As(err, &tooManyLoginAttemptsError) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(tooManyLoginAttemptsError.RetryAfter.Seconds()))))
+		}
+		return err
+	}
+	return nil
+}
+
+func loginFailuresKey(kind, value string) string {
+	return fmt.Sprintf("login_failures:%s:%s", kind, value)
+}
+
+func loginLockKey(kind, value string) string {
+	return fmt.Sprintf("login_lock:%s:%s", kind, value)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPMailer{
+		addr: fmt.Sprintf("%s:%d", host, port),
+		from: from,
+		auth: auth,
+	}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, formatMail(m.from, mail))
+	if err != nil {
+		return errors.Wrap(err, "smtp SendMail")
+	}
+	return nil
+}
+
+// OutboxMailer keeps sent mails in memory instead of sending them, so they can
+// be inspected in tests. If dir is not empty, every mail is also written there
+// as a file for development
+type OutboxMailer struct {
+	dir string
+
+	mu    sync.Mutex
+	mails []Mail
+}
+
+func NewOutboxMailer(dir string) *OutboxMailer {
+	return &OutboxMailer{
+		dir: dir,
+	}
+}
+
+func (m *OutboxMailer) Send(ctx context.Context, mail Mail) error {
+	m.mu.Lock()
+	m.mails = append(m.mails, mail)
+	m.mu.Unlock()
+
+	if m.dir == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(m.dir, 0744)
+	if err != nil {
+		return errors.Wrap(err, "create outbox dir")
+	}
+
+	fileName := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(mail.To, "@", "_at_"))
+	err = os.WriteFile(filepath.Join(m.dir, fileName), formatMail("outbox@localhost", mail), 0644)
+	if err != nil {
+		return errors.Wrap(err, "write mail to outbox dir")
+	}
+
+	return nil
+}
+
+// Mails returns copy of mails sent so far
+func (m *OutboxMailer) Mails() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mails := make([]Mail, len(m.mails))
+	copy(mails, m.mails)
+	return mails
+}
+
+// LastMailTo returns the most recent mail sent to address, nil if there is none
+func (m *OutboxMailer) LastMailTo(to string) *Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.mails) - 1; i >= 0; i -= 1 {
+		if m.mails[i].To == to {
+			mail := m.mails[i]
+			return &mail
+		}
+	}
+	return nil
+}
+
+func formatMail(from string, mail Mail) []byte {
+	headers := []string{
+		fmt.Sprintf("From: %s", from),
+		fmt.Sprintf("To: %s", mail.To),
+		fmt.Sprintf("Subject: %s", mail.Subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + mail.Body)
+}
+
+// getMailer returns mailer selected by `MAILER`, either `smtp` or `outbox`.
+// It has to be set explicitly, as outbox does not deliver mails and keeps
+// all of them in memory, so it is only for development and tests
+func getMailer(config *Config) Mailer {
+	switch mailer := config.GetString("MAILER"); mailer {
+	case "smtp":
+		host := config.GetString("SMTP_HOST")
+		from := config.GetString("MAIL_FROM")
+		if host == "" || from == "" {
+			panic(fmt.Errorf("SMTP_HOST and MAIL_FROM are required by smtp mailer for config %s", config.ConfigFileUsed()))
+		}
+
+		return NewSMTPMailer(
+			host,
+			config.GetInt("SMTP_PORT"),
+			config.GetString("SMTP_USERNAME"),
+			config.GetString("SMTP_PASSWORD"),
+			from,
+		)
+	case "outbox":
+		return NewOutboxMailer(config.GetString("OUTBOX_DIR"))
+	default:
+		panic(fmt.Errorf("MAILER must be smtp or outbox, got %q for config %s", mailer, config.ConfigFileUsed()))
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+func TestOutboxMailer(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	outbox := NewOutboxMailer(dir)
+
+	mails := []Mail{
+		{To: "a@test.com", Subject: "first", Body: "first body"},
+		{To: "b@test.com", Subject: "second", Body: "second body"},
+		{To: "a@test.com", Subject: "third", Body: "third body"},
+	}
+	for _, mail := range mails {
+		err := outbox.Send(context.Background(), mail)
+		utils.AssertEqual(t, nil, err)
+	}
+
+	utils.AssertEqual(t, mails, outbox.Mails())
+	utils.AssertEqual(t, "third", outbox.LastMailTo("a@test.com").Subject)
+	utils.AssertEqual(t, true, outbox.LastMailTo("c@test.com") == nil)
+
+	files, err := os.ReadDir(dir)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, len(mails), len(files))
+
+	b, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, true, strings.Contains(string(b), "Subject: "))
+}
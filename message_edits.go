@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// MessageEditedSchema is sent to members of chat subscribed to it when
+// message of the chat is edited
+type MessageEditedSchema struct {
+	BaseMessageSchema
+
+	ChatID    uint
+	MessageID uint
+	Message   string
+	EditedAt  time.Time
+}
+
+// MessageDeletedSchema is sent to members of chat subscribed to it when
+// message of the chat is deleted
+type MessageDeletedSchema struct {
+	BaseMessageSchema
+
+	ChatID    uint
+	MessageID uint
+}
+
+// requireMessageModification loads message of chat and returns
+// `ForbiddenError` if user can not edit or delete it
+func requireMessageModification(db *gorm.DB, user *User, chatID uint, messageID uint) (*Message, error) {
+	var chat Chat
+	err := db.First(&chat, chatID).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Get chat by id")
+	}
+
+	var message Message
+	err = db.Where("chat_id = ?", chatID).First(&message, messageID).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Get message by id")
+	}
+
+	member, err := getChatMember(db, chatID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canModifyMessage(user, &chat, member, &message) {
+		return nil, &ForbiddenError{}
+	}
+
+	return &message, nil
+}
+
+// editChatMessage replaces content of message and tells members of its chat
+// about it
+func editChatMessage(ctx context.Context, db *gorm.DB, broker Broker, user *User, chatID uint, messageID uint, content string) (*Message, error) {
+	message, err := requireMessageModification(db, user, chatID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = editMessage(db, message, user.ID, content)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := newMessageEditedFrame(message)
+	if err != nil {
+		return nil, err
+	}
+
+	err = publishMessageChange(ctx, db, broker, chatID, b)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// deleteChatMessage soft deletes message and tells members of its chat about
+// it. Content of message stays in database, but is not shown anymore
+func deleteChatMessage(ctx context.Context, db *gorm.DB, broker Broker, user *User, chatID uint, messageID uint) error {
+	message, err := requireMessageModification(db, user, chatID, messageID)
+	if err != nil {
+		return err
+	}
+
+	err = db.Delete(message).Error
+	if err != nil {
+		return errors.Wrap(err, "Delete message")
+	}
+
+	b, err := newMessageDeletedFrame(message)
+	if err != nil {
+		return err
+	}
+
+	return publishMessageChange(ctx, db, broker, chatID, b)
+}
+
+func newMessageEditedFrame(message *Message) ([]byte, error) {
+	b, err := json.Marshal(MessageEditedSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type: "message_edited",
+		},
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+		Message:   message.Content,
+		EditedAt:  *message.EditedAt,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshall MessageEditedSchema")
+	}
+	return b, nil
+}
+
+func newMessageDeletedFrame(message *Message) ([]byte, error) {
+	b, err := json.Marshal(MessageDeletedSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type: "message_deleted",
+		},
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshall MessageDeletedSchema")
+	}
+	return b, nil
+}
+
+// publishMessageChange sends event to every member of chat, including the one
+// who made the change, so their other connections are updated too
+func publishMessageChange(ctx context.Context, db *gorm.DB, broker Broker, chatID uint, message []byte) error {
+	userIDs, err := getChatUsersExcept(db, chatID, 0)
+	if err != nil {
+		return errors.Wrap(err, "getChatUsersExcept")
+	}
+
+	// only already shown messages change, so there is no notification
+	return broker.Publish(ctx, ChatEvent{
+		ChatID:  chatID,
+		UserIDs: userIDs,
+		Message: message,
+	})
+}
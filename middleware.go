@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"net/url"
+	"strings"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
 )
 
 func IndentJSONResponseMiddleware(c *fiber.Ctx) error {
@@ -34,11 +39,158 @@ func IndentJSONResponseMiddleware(c *fiber.Ctx) error {
 	return nil
 }
 
+// SameOriginMiddleware rejects requests made by pages of other sites, which
+// browsers still send with session cookie, e.g. websocket handshakes and
+// event streams that are not covered by CORS. Browsers send `Origin` header
+// with such requests, so requests without it are let through
+func SameOriginMiddleware(c *fiber.Ctx) error {
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		return c.Next()
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil || originURL.Host != string(c.Request().Host()) {
+		return fiber.NewError(fiber.StatusForbidden, "cross-origin request is not allowed")
+	}
+
+	return c.Next()
+}
+
+// AssertWebSocketUpgradeMiddleware also authenticates the handshake by session
+// cookie or bearer token, so connection is bound to that user. Must be used
+// after `CurrentUserMiddleware`
 func AssertWebSocketUpgradeMiddleware(c *fiber.Ctx) error {
 	// IsWebSocketUpgrade returns true if the client
 	// requested upgrade to the WebSocket protocol.
-	if websocket.IsWebSocketUpgrade(c) {
-		return c.Next()
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	if getCurrentUser(c) == nil {
+		return &UnauthorizedUserError{}
+	}
+
+	return c.Next()
+}
+
+// CurrentUserMiddleware resolves user of the session once per request and
+// stores it in c.Locals("currentUser"), nil for anonymous requests
+func CurrentUserMiddleware(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	if isBearerAuthAllowed(c) && getBearerToken(c) != "" {
+		return handleBearerAuth(c, db)
+	}
+
+	sessionCurrentUser, err := getLoggedInUser(c)
+	if err != nil {
+		_, isUnauthorizedUserError := err.(*UnauthorizedUserError)
+		if isUnauthorizedUserError {
+			c.Locals("currentUser", (*User)(nil))
+			return c.Next()
+		}
+		return errors.Wrap(err, "getLoggedInUser")
+	}
+
+	sessionID := c.Cookies(SessionIDCookieKey)
+	c.Locals("sessionID", sessionID)
+
+	registry, ok := c.Locals("sessions").(*SessionRegistry)
+	if !ok {
+		log.Fatal("error getting `sessions` from c.Locals()")
+	}
+	err = registry.Touch(c.Context(), sessionCurrentUser.ID, sessionID)
+	if err != nil {
+		return err
+	}
+
+	var user *User
+	tx := db.Limit(1).Find(&user, sessionCurrentUser.ID)
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "Get user by id")
+	}
+	if tx.RowsAffected == 0 {
+		// user was deleted after session was created
+		user = nil
+	}
+
+	c.Locals("currentUser", user)
+	return c.Next()
+}
+
+// isBearerAuthAllowed reports whether request may be authenticated with
+// bearer token. UI keeps using cookie sessions only
+func isBearerAuthAllowed(c *fiber.Ctx) bool {
+	path := c.Path()
+	return strings.HasPrefix(path, "/api") || strings.HasPrefix(path, "/ws")
+}
+
+func getBearerToken(c *fiber.Ctx) string {
+	authorization := c.Get(fiber.HeaderAuthorization)
+	token, found := strings.CutPrefix(authorization, "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func handleBearerAuth(c *fiber.Ctx, db *gorm.DB) error {
+	tokenManager, ok := c.Locals("tokens").(*TokenManager)
+	if !ok {
+		log.Fatal("error getting `tokens` from c.Locals()")
+	}
+
+	claims, err := tokenManager.ParseAccessToken(c.Context(), getBearerToken(c))
+	if err != nil {
+		return err
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		return &InvalidTokenError{}
+	}
+
+	var user User
+	err = db.First(&user, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &InvalidTokenError{}
+	} else if err != nil {
+		return errors.Wrap(err, "Get user by id")
+	}
+
+	c.Locals("currentUser", &user)
+	c.Locals("accessTokenClaims", claims)
+	return c.Next()
+}
+
+// RequireAPIAuthMiddleware responds with 401 JSON to anonymous requests
+func RequireAPIAuthMiddleware(c *fiber.Ctx) error {
+	if getCurrentUser(c) == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(GlobalErrorHandlerResponse{
+			Success: false,
+			Message: (&UnauthorizedUserError{}).Error(),
+		})
+	}
+	return c.Next()
+}
+
+// RequireUIAuthMiddleware redirects anonymous requests to login page
+func RequireUIAuthMiddleware(c *fiber.Ctx) error {
+	if getCurrentUser(c) == nil {
+		return c.Redirect("/ui/login", fiber.StatusSeeOther)
+	}
+	return c.Next()
+}
+
+// RequireSiteAdminMiddleware responds with 403 to users who are not site
+// admins. Must be used after `RequireAPIAuthMiddleware`
+func RequireSiteAdminMiddleware(c *fiber.Ctx) error {
+	if !getCurrentUser(c).IsAdmin {
+		return &ForbiddenError{}
 	}
-	return fiber.ErrUpgradeRequired
+	return c.Next()
 }
@@ -1,25 +1,63 @@
 package main
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type User struct {
 	gorm.Model
 
 	Name string `validate:"required"`
 
-	Email string `gorm:"uniqueIndex" validate:"required"`
-	// TODO: for now without hashing :)
-	Password string
+	// Email is stored normalized, index on its lowercase form keeps emails
+	// saved before normalization unique too
+	Email string `gorm:"uniqueIndex:idx_users_lower_email,expression:lower(email)" validate:"required"`
+	// Password is accepted on input only, it is hashed into PasswordHash on
+	// save and never stored as is
+	Password     string `gorm:"-" json:",omitempty"`
+	PasswordHash string `json:"-"`
+
+	// EmailVerifiedAt is nil until user opens link from verification email
+	EmailVerifiedAt *time.Time
+
+	// IsAdmin marks site admins, who have every permission in every chat
+	IsAdmin bool
+
+	// TOTPSecret is set on enrollment, but second factor is required only
+	// after TOTPEnabled is set by confirming the first code
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool
 
 	// TODO: add `images` prefix e.g. `images/{filename}.jpg` to this url
 	// TODO: use random name for file names
 	AvatarURL string
 
+	// Presence is kept in Redis and is set only by handlers that show it
+	Presence *Presence `gorm:"-" json:",omitempty"`
+
 	Chats []Chat `gorm:"many2many:chat_members"`
 
 	Messages []Message `gorm:"foreignKey:FromID"`
 }
 
+func (u *User) BeforeSave(tx *gorm.DB) error {
+	u.Email = normalizeEmail(u.Email)
+
+	if u.Password == "" {
+		return nil
+	}
+
+	passwordHash, err := hashPassword(u.Password)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = passwordHash
+
+	return nil
+}
+
 type Message struct {
 	gorm.Model
 
@@ -27,9 +65,32 @@ type Message struct {
 	ChatID uint `validate:"required"`
 
 	From   User
-	FromID uint `validate:"required"`
+	FromID uint `gorm:"uniqueIndex:idx_messages_from_client_message_id" validate:"required"`
 
 	Content string `validate:"required"`
+
+	// ClientMessageID is generated by client to make retried sends idempotent,
+	// it is unique per sender
+	ClientMessageID *string `gorm:"uniqueIndex:idx_messages_from_client_message_id" json:",omitempty"`
+
+	// EditedAt is nil until message is edited, previous contents are kept as
+	// `MessageRevision`
+	EditedAt *time.Time
+}
+
+// MessageRevision is content of message before one of its edits
+type MessageRevision struct {
+	ID uint `gorm:"primarykey"`
+
+	Message   Message
+	MessageID uint `gorm:"index"`
+
+	Content string
+
+	EditedBy   User
+	EditedByID uint
+
+	CreatedAt time.Time
 }
 
 type Chat struct {
@@ -38,5 +99,38 @@ type Chat struct {
 	Name    string `gorm:"uniqueIndex" validate:"required"`
 	Members []User `gorm:"many2many:chat_members"`
 
+	// IsPrivate chats can not be joined by users themselves
+	IsPrivate bool
+
 	Messages []Message
+
+	// UnreadCount is count of messages of others unread by current user, it is
+	// set only for chats current user is a member of
+	UnreadCount *int64 `gorm:"-" json:",omitempty"`
+}
+
+// HasUnreadMessages is used by templates, as they can not compare
+// `UnreadCount` pointer with zero
+func (chat Chat) HasUnreadMessages() bool {
+	return chat.UnreadCount != nil && *chat.UnreadCount > 0
+}
+
+const (
+	ChatRoleOwner  = "owner"
+	ChatRoleAdmin  = "admin"
+	ChatRoleMember = "member"
+)
+
+// ChatMember is a join table between `Chat` and `User`
+type ChatMember struct {
+	ChatID uint `gorm:"primaryKey"`
+	UserID uint `gorm:"primaryKey"`
+
+	Role string `gorm:"default:member" validate:"oneof=owner admin member"`
+
+	// LastReadMessageID is ID of the last message of chat read by member, it
+	// only grows
+	LastReadMessageID uint `gorm:"not null;default:0"`
+
+	CreatedAt time.Time
 }
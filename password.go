@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyPasswordHash is compared against when user is not found, so that
+// response time does not reveal which emails are registered. It has the same
+// cost as real hashes and is created lazily, as cost depends on test flags
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	b, _ := bcrypt.GenerateFromPassword([]byte("dummy-password"), getPasswordHashCost())
+	return b
+})
+
+func getPasswordHashCost() int {
+	if isTesting() {
+		return bcrypt.MinCost
+	}
+	return bcrypt.DefaultCost
+}
+
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), getPasswordHashCost())
+	if err != nil {
+		return "", errors.Wrap(err, "bcrypt GenerateFromPassword")
+	}
+	return string(b), nil
+}
+
+func verifyPassword(passwordHash, password string) bool {
+	if passwordHash == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return false
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	return err == nil
+}
+
+// passwordNeedsRehash reports whether hash was created with other parameters
+// than the ones currently used
+func passwordNeedsRehash(passwordHash string) bool {
+	cost, err := bcrypt.Cost([]byte(passwordHash))
+	if err != nil {
+		return true
+	}
+	return cost != getPasswordHashCost()
+}
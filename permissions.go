@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type ChatPermission int
+
+const (
+	ChatPermissionJoin ChatPermission = iota
+	ChatPermissionRename
+	ChatPermissionDelete
+	ChatPermissionRemoveMembers
+	// ChatPermissionManageMembers allows adding other users to chat, it is
+	// the only way into private chats
+	ChatPermissionManageMembers
+	ChatPermissionModerateMessages
+	ChatPermissionManageRoles
+	ChatPermissionReadMessages
+)
+
+// hasChatPermission checks permission of user in chat. member is user's
+// membership in the chat, nil if user is not a member
+func hasChatPermission(user *User, chat *Chat, member *ChatMember, permission ChatPermission) bool {
+	if user == nil {
+		return false
+	}
+	if user.IsAdmin {
+		return true
+	}
+
+	if permission == ChatPermissionJoin {
+		return !chat.IsPrivate
+	}
+
+	// messages of public chats are readable by anyone, as they can join
+	if permission == ChatPermissionReadMessages && !chat.IsPrivate {
+		return true
+	}
+
+	if member == nil {
+		return false
+	}
+
+	switch permission {
+	case ChatPermissionReadMessages:
+		return true
+	case ChatPermissionRename, ChatPermissionRemoveMembers, ChatPermissionManageMembers, ChatPermissionModerateMessages:
+		return member.Role == ChatRoleOwner || member.Role == ChatRoleAdmin
+	case ChatPermissionDelete, ChatPermissionManageRoles:
+		return member.Role == ChatRoleOwner
+	default:
+		return false
+	}
+}
+
+// canRemoveChatMember checks whether user with membership actor can remove
+// target from chat. Members can leave chats themselves, chat admins can
+// remove members and chat owner can remove everyone. Nobody can remove the
+// owner, chat has to be deleted instead
+func canRemoveChatMember(user *User, chat *Chat, actor, target *ChatMember) bool {
+	if target.Role == ChatRoleOwner {
+		return false
+	}
+
+	if user.IsAdmin {
+		return true
+	}
+
+	if actor == nil {
+		return false
+	}
+
+	if actor.UserID == target.UserID {
+		return true
+	}
+
+	if !hasChatPermission(user, chat, actor, ChatPermissionRemoveMembers) {
+		return false
+	}
+
+	return actor.Role == ChatRoleOwner || target.Role == ChatRoleMember
+}
+
+// canModifyMessage checks whether user with membership member can edit or
+// delete message. Authors can modify their messages while they are members,
+// chat admins can modify every message
+func canModifyMessage(user *User, chat *Chat, member *ChatMember, message *Message) bool {
+	if member != nil && message.FromID == user.ID {
+		return true
+	}
+
+	return hasChatPermission(user, chat, member, ChatPermissionModerateMessages)
+}
+
+// getChatMember returns membership of user in chat, nil if user is not a
+// member
+func getChatMember(db *gorm.DB, chatID, userID uint) (*ChatMember, error) {
+	var member ChatMember
+	tx := db.Where("chat_id = ? AND user_id = ?", chatID, userID).Limit(1).Find(&member)
+	if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "Get chat member")
+	}
+	if tx.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &member, nil
+}
+
+// filterReadableChats removes private chats user can not read from chats, so
+// that they and their members are not listed. user is nil for anonymous
+// requests
+func filterReadableChats(db *gorm.DB, user *User, chats []Chat) ([]Chat, error) {
+	members := map[uint]*ChatMember{}
+	if user != nil {
+		var userMembers []ChatMember
+		err := db.Where("user_id = ?", user.ID).Find(&userMembers).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "Get chat members of user")
+		}
+		for i := range userMembers {
+			members[userMembers[i].ChatID] = &userMembers[i]
+		}
+	}
+
+	readableChats := make([]Chat, 0, len(chats))
+	for i := range chats {
+		chat := &chats[i]
+		if !chat.IsPrivate || hasChatPermission(user, chat, members[chat.ID], ChatPermissionReadMessages) {
+			readableChats = append(readableChats, *chat)
+		}
+	}
+	return readableChats, nil
+}
+
+// requireChatPermission loads chat and membership of user in it and returns
+// `ForbiddenError` if user does not have permission
+func requireChatPermission(db *gorm.DB, user *User, chatID uint, permission ChatPermission) (*Chat, *ChatMember, error) {
+	var chat Chat
+	err := db.First(&chat, chatID).Error
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Get chat by id")
+	}
+
+	member, err := getChatMember(db, chatID, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !hasChatPermission(user, &chat, member, permission) {
+		return nil, nil, &ForbiddenError{}
+	}
+
+	return &chat, member, nil
+}
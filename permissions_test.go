@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+func Test_hasChatPermission(t *testing.T) {
+	t.Parallel()
+
+	user := &User{}
+	siteAdmin := &User{IsAdmin: true}
+	publicChat := &Chat{}
+	privateChat := &Chat{IsPrivate: true}
+	owner := &ChatMember{Role: ChatRoleOwner}
+	admin := &ChatMember{Role: ChatRoleAdmin}
+	member := &ChatMember{Role: ChatRoleMember}
+
+	testCases := []struct {
+		user       *User
+		chat       *Chat
+		member     *ChatMember
+		permission ChatPermission
+		expected   bool
+	}{
+		{nil, publicChat, nil, ChatPermissionJoin, false},
+		{user, publicChat, nil, ChatPermissionJoin, true},
+		{user, privateChat, nil, ChatPermissionJoin, false},
+		{siteAdmin, privateChat, nil, ChatPermissionJoin, true},
+		{user, publicChat, nil, ChatPermissionRename, false},
+		{user, publicChat, member, ChatPermissionRename, false},
+		{user, publicChat, admin, ChatPermissionRename, true},
+		{user, publicChat, admin, ChatPermissionModerateMessages, true},
+		{user, publicChat, admin, ChatPermissionDelete, false},
+		{user, publicChat, admin, ChatPermissionManageRoles, false},
+		{user, privateChat, nil, ChatPermissionManageMembers, false},
+		{user, privateChat, member, ChatPermissionManageMembers, false},
+		{user, privateChat, admin, ChatPermissionManageMembers, true},
+		{user, privateChat, owner, ChatPermissionManageMembers, true},
+		{siteAdmin, privateChat, nil, ChatPermissionManageMembers, true},
+		{user, publicChat, owner, ChatPermissionDelete, true},
+		{user, publicChat, owner, ChatPermissionManageRoles, true},
+		{siteAdmin, publicChat, nil, ChatPermissionDelete, true},
+		{user, publicChat, nil, ChatPermissionReadMessages, true},
+		{user, privateChat, nil, ChatPermissionReadMessages, false},
+		{user, privateChat, member, ChatPermissionReadMessages, true},
+		{siteAdmin, privateChat, nil, ChatPermissionReadMessages, true},
+	}
+
+	for i, tc := range testCases {
+		got := hasChatPermission(tc.user, tc.chat, tc.member, tc.permission)
+		utils.AssertEqual(t, tc.expected, got, fmt.Sprintf("test case %d", i))
+	}
+}
+
+func Test_canRemoveChatMember(t *testing.T) {
+	t.Parallel()
+
+	user := &User{}
+	siteAdmin := &User{IsAdmin: true}
+	chat := &Chat{}
+	owner := &ChatMember{UserID: 1, Role: ChatRoleOwner}
+	admin := &ChatMember{UserID: 2, Role: ChatRoleAdmin}
+	otherAdmin := &ChatMember{UserID: 3, Role: ChatRoleAdmin}
+	member := &ChatMember{UserID: 4, Role: ChatRoleMember}
+	otherMember := &ChatMember{UserID: 5, Role: ChatRoleMember}
+
+	testCases := []struct {
+		user          *User
+		actor, target *ChatMember
+		expected      bool
+	}{
+		{user, member, member, true},
+		{user, member, otherMember, false},
+		{user, nil, member, false},
+		{user, admin, member, true},
+		{user, admin, otherAdmin, false},
+		{user, admin, admin, true},
+		{user, owner, admin, true},
+		{user, owner, owner, false},
+		{siteAdmin, nil, admin, true},
+		{siteAdmin, nil, owner, false},
+	}
+
+	for i, tc := range testCases {
+		got := canRemoveChatMember(tc.user, chat, tc.actor, tc.target)
+		utils.AssertEqual(t, tc.expected, got, fmt.Sprintf("test case %d", i))
+	}
+}
+
+func Test_canModifyMessage(t *testing.T) {
+	t.Parallel()
+
+	user := &User{}
+	user.ID = 1
+	siteAdmin := &User{IsAdmin: true}
+	chat := &Chat{}
+	member := &ChatMember{UserID: 1, Role: ChatRoleMember}
+	admin := &ChatMember{UserID: 1, Role: ChatRoleAdmin}
+	ownMessage := &Message{FromID: 1}
+	otherMessage := &Message{FromID: 2}
+
+	testCases := []struct {
+		user     *User
+		member   *ChatMember
+		message  *Message
+		expected bool
+	}{
+		{user, member, ownMessage, true},
+		{user, member, otherMessage, false},
+		{user, nil, ownMessage, false},
+		{user, admin, otherMessage, true},
+		{siteAdmin, nil, otherMessage, true},
+	}
+
+	for i, tc := range testCases {
+		got := canModifyMessage(tc.user, chat, tc.member, tc.message)
+		utils.AssertEqual(t, tc.expected, got, fmt.Sprintf("test case %d", i))
+	}
+}
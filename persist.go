@@ -1,26 +1,122 @@
 package main
 
 import (
+	"time"
+
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-func saveMessage(db *gorm.DB, userEmail string, chatID uint, messageContent string) (uint, error) {
-	var user User
-	tx := db.Where("Email = ?", userEmail).First(&user)
-	if tx.Error != nil {
-		return 0, tx.Error
-	}
-
+// saveMessage creates message. If clientMessageID is not empty and sender
+// already has message with it, that message is returned and false is
+// returned as the second value. The existing message may be deleted already
+func saveMessage(db *gorm.DB, userID uint, chatID uint, messageContent string, clientMessageID string) (*Message, bool, error) {
 	message := Message{
 		ChatID:  chatID,
-		FromID:  user.ID,
+		FromID:  userID,
 		Content: messageContent,
 	}
-	tx = db.Create(&message)
+	if clientMessageID == "" {
+		tx := db.Create(&message)
+		if tx.Error != nil {
+			return nil, false, errors.Wrap(tx.Error, "db create message failed")
+		}
+		return &message, true, nil
+	}
+
+	message.ClientMessageID = &clientMessageID
+	tx := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&message)
 	if tx.Error != nil {
-		return 0, errors.Wrap(tx.Error, "db create message failed")
+		return nil, false, errors.Wrap(tx.Error, "db create message failed")
+	}
+	if tx.RowsAffected == 1 {
+		return &message, true, nil
+	}
+
+	var existingMessage Message
+	err := db.Unscoped().Where("from_id = ? AND client_message_id = ?", userID, clientMessageID).First(&existingMessage).Error
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Get message by client message id")
+	}
+	return &existingMessage, false, nil
+}
+
+// addChatMember adds user to chat with role. Messages sent before user joined
+// are marked read, so that the whole history is not shown as unread. If user
+// is a member already, existing membership is returned and false is returned
+// as the second value
+func addChatMember(db *gorm.DB, chatID uint, userID uint, role string) (*ChatMember, bool, error) {
+	var lastMessageID uint
+	err := db.Unscoped().Model(&Message{}).
+		Where("chat_id = ?", chatID).
+		Select("COALESCE(MAX(id), 0)").
+		Scan(&lastMessageID).Error
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Get last message of chat")
+	}
+
+	member := ChatMember{
+		ChatID:            chatID,
+		UserID:            userID,
+		Role:              role,
+		LastReadMessageID: lastMessageID,
 	}
+	tx := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&member)
+	if tx.Error != nil {
+		return nil, false, errors.Wrap(tx.Error, "Create chat member")
+	}
+	if tx.RowsAffected == 1 {
+		return &member, true, nil
+	}
+
+	var existingMember ChatMember
+	err = db.Where("chat_id = ? AND user_id = ?", chatID, userID).First(&existingMember).Error
+	if err != nil {
+		return nil, false, errors.Wrap(err, "Get chat member")
+	}
+	return &existingMember, false, nil
+}
+
+// markMessagesRead moves last read message of member of chat forward to
+// messageID. Deleted message is a valid read cursor too, as it may be the
+// last one shown. It returns false if member has already read the message
+func markMessagesRead(db *gorm.DB, userID uint, chatID uint, messageID uint) (bool, error) {
+	var message Message
+	err := db.Unscoped().Where("id = ? AND chat_id = ?", messageID, chatID).First(&message).Error
+	if err != nil {
+		return false, errors.Wrap(err, "Get message of chat")
+	}
+
+	tx := db.Model(&ChatMember{}).
+		Where("chat_id = ? AND user_id = ? AND last_read_message_id < ?", chatID, userID, messageID).
+		Update("LastReadMessageID", messageID)
+	if tx.Error != nil {
+		return false, errors.Wrap(tx.Error, "Update last read message")
+	}
+	return tx.RowsAffected == 1, nil
+}
+
+// editMessage replaces content of message and keeps the previous one as its
+// revision
+func editMessage(db *gorm.DB, message *Message, editorID uint, content string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&MessageRevision{
+			MessageID:  message.ID,
+			Content:    message.Content,
+			EditedByID: editorID,
+		}).Error
+		if err != nil {
+			return errors.Wrap(err, "Create message revision")
+		}
 
-	return message.ID, nil
+		editedAt := time.Now()
+		message.Content = content
+		message.EditedAt = &editedAt
+		err = tx.Model(message).Select("Content", "EditedAt").Updates(message).Error
+		if err != nil {
+			return errors.Wrap(err, "Update message")
+		}
+		return nil
+	})
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
+	goredis "github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// user with open connection is away once there were no frames from user for
+// `presenceAwayAfter`
+const presenceAwayAfter = 5 * time.Minute
+const presenceActivityInterval = time.Minute
+const presenceLastSeenTTL = 30 * 24 * time.Hour
+
+type Presence struct {
+	Status string
+	// LastSeenAt is time user was connected last time, it is nil if user was
+	// not seen for `presenceLastSeenTTL`
+	LastSeenAt *time.Time `json:",omitempty"`
+}
+
+// PresenceSchema is sent to users sharing a chat with user whose presence
+// has changed
+type PresenceSchema struct {
+	BaseMessageSchema
+
+	UserID uint
+	Presence
+}
+
+// PresenceTracker keeps websocket connections of users in Redis, so presence
+// is shared by all instances of the app. Connection expires unless it is
+// refreshed by heartbeat, so connections of crashed instance do not keep user
+// online
+type PresenceTracker struct {
+	redis         goredis.UniversalClient
+	connectionTTL time.Duration
+}
+
+func NewPresenceTracker(redisClient goredis.UniversalClient, connectionTTL time.Duration) *PresenceTracker {
+	return &PresenceTracker{
+		redis:         redisClient,
+		connectionTTL: connectionTTL,
+	}
+}
+
+// Connect adds connection of user, opening connection counts as activity
+func (p *PresenceTracker) Connect(ctx context.Context, userID uint, connectionID string) error {
+	err := p.Heartbeat(ctx, userID, connectionID)
+	if err != nil {
+		return err
+	}
+
+	return p.Activity(ctx, userID)
+}
+
+// Heartbeat extends expiry of connection of user
+func (p *PresenceTracker) Heartbeat(ctx context.Context, userID uint, connectionID string) error {
+	now := time.Now()
+	connectionsKey := presenceConnectionsKey(userID)
+
+	pipe := p.redis.TxPipeline()
+	pipe.ZAdd(ctx, connectionsKey, goredis.Z{
+		Score:  float64(now.Add(p.connectionTTL).UnixMilli()),
+		Member: connectionID,
+	})
+	pipe.ZRemRangeByScore(ctx, connectionsKey, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	pipe.Expire(ctx, connectionsKey, p.connectionTTL)
+	pipe.Set(ctx, lastSeenKey(userID), now.Unix(), presenceLastSeenTTL)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "redis presence heartbeat")
+	}
+	return nil
+}
+
+// Activity marks user as not away
+func (p *PresenceTracker) Activity(ctx context.Context, userID uint) error {
+	pipe := p.redis.TxPipeline()
+	pipe.Set(ctx, presenceActiveKey(userID), 1, presenceAwayAfter)
+	pipe.Set(ctx, lastSeenKey(userID), time.Now().Unix(), presenceLastSeenTTL)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "redis presence activity")
+	}
+	return nil
+}
+
+func (p *PresenceTracker) Disconnect(ctx context.Context, userID uint, connectionID string) error {
+	pipe := p.redis.TxPipeline()
+	pipe.ZRem(ctx, presenceConnectionsKey(userID), connectionID)
+	pipe.Set(ctx, lastSeenKey(userID), time.Now().Unix(), presenceLastSeenTTL)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "redis presence disconnect")
+	}
+	return nil
+}
+
+// Get returns presence of every user of userIDs
+func (p *PresenceTracker) Get(ctx context.Context, userIDs []uint) (map[uint]Presence, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	connections := make([]*goredis.IntCmd, len(userIDs))
+	isActive := make([]*goredis.IntCmd, len(userIDs))
+	lastSeen := make([]*goredis.StringCmd, len(userIDs))
+
+	pipe := p.redis.Pipeline()
+	for i, userID := range userIDs {
+		connections[i] = pipe.ZCount(ctx, presenceConnectionsKey(userID), "("+now, "+inf")
+		isActive[i] = pipe.Exists(ctx, presenceActiveKey(userID))
+		lastSeen[i] = pipe.Get(ctx, lastSeenKey(userID))
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && !errors.Is(err, goredis.Nil) {
+		return nil, errors.Wrap(err, "redis get presence")
+	}
+
+	presences := make(map[uint]Presence, len(userIDs))
+	for i, userID := range userIDs {
+		presence := Presence{
+			Status: PresenceOffline,
+		}
+		if connections[i].Val() > 0 {
+			presence.Status = PresenceAway
+			if isActive[i].Val() > 0 {
+				presence.Status = PresenceOnline
+			}
+		}
+
+		lastSeenUnix, err := lastSeen[i].Int64()
+		if err == nil {
+			lastSeenAt := time.Unix(lastSeenUnix, 0)
+			presence.LastSeenAt = &lastSeenAt
+		}
+
+		presences[userID] = presence
+	}
+	return presences, nil
+}
+
+// Refresh returns presence of user and whether its status has changed since
+// the previous call for user on any instance
+func (p *PresenceTracker) Refresh(ctx context.Context, userID uint) (Presence, bool, error) {
+	presences, err := p.Get(ctx, []uint{userID})
+	if err != nil {
+		return Presence{}, false, err
+	}
+	presence := presences[userID]
+
+	previousStatus, err := p.redis.SetArgs(ctx, presenceStatusKey(userID), presence.Status, goredis.SetArgs{
+		Get: true,
+		TTL: presenceLastSeenTTL,
+	}).Result()
+	if errors.Is(err, goredis.Nil) {
+		previousStatus = PresenceOffline
+	} else if err != nil {
+		return Presence{}, false, errors.Wrap(err, "redis set presence status")
+	}
+
+	return presence, previousStatus != presence.Status, nil
+}
+
+// setUsersPresence fills Presence of users
+func setUsersPresence(ctx context.Context, presenceTracker *PresenceTracker, users []User) error {
+	userIDs := make([]uint, len(users))
+	for i, user := range users {
+		userIDs[i] = user.ID
+	}
+
+	presences, err := presenceTracker.Get(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range users {
+		presence := presences[users[i].ID]
+		users[i].Presence = &presence
+	}
+	return nil
+}
+
+// updatePresence calls update and tells users sharing a chat with user if
+// status of user has changed. Presence is not essential for connection, so
+// errors are only logged
+func updatePresence(db *gorm.DB, broker Broker, presenceTracker *PresenceTracker, user *User, update func(ctx context.Context) error) {
+	ctx := context.Background()
+
+	err := update(ctx)
+	if err != nil {
+		log.Errorf("update presence userID=%d err=%s\n", user.ID, err)
+		return
+	}
+
+	presence, isChanged, err := presenceTracker.Refresh(ctx, user.ID)
+	if err != nil {
+		log.Errorf("refresh presence userID=%d err=%s\n", user.ID, err)
+		return
+	}
+	if !isChanged {
+		return
+	}
+
+	err = publishPresence(ctx, db, broker, user, presence)
+	if err != nil {
+		log.Errorf("publish presence userID=%d err=%s\n", user.ID, err)
+	}
+}
+
+func publishPresence(ctx context.Context, db *gorm.DB, broker Broker, user *User, presence Presence) error {
+	b, err := json.Marshal(PresenceSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type: "presence",
+		},
+		UserID:   user.ID,
+		Presence: presence,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshall PresenceSchema")
+	}
+
+	userIDs, err := getUsersSharingChat(db, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "getUsersSharingChat")
+	}
+
+	// event without chat is sent to every connection of users
+	return broker.Publish(ctx, ChatEvent{
+		UserIDs: userIDs,
+		Message: b,
+	})
+}
+
+func presenceConnectionsKey(userID uint) string {
+	return fmt.Sprintf("presence_connections:%d", userID)
+}
+
+func presenceActiveKey(userID uint) string {
+	return fmt.Sprintf("presence_active:%d", userID)
+}
+
+func presenceStatusKey(userID uint) string {
+	return fmt.Sprintf("presence_status:%d", userID)
+}
+
+func lastSeenKey(userID uint) string {
+	return fmt.Sprintf("last_seen:%d", userID)
+}
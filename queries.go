@@ -1,6 +1,11 @@
 package main
 
-import "gorm.io/gorm"
+import (
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 func getChatUsersExcept(db *gorm.DB, chatID, skipUserID uint) ([]uint, error) {
 	var users []User
@@ -18,3 +23,144 @@ func getChatUsersExcept(db *gorm.DB, chatID, skipUserID uint) ([]uint, error) {
 	}
 	return userIDs, nil
 }
+
+// getUsersSharingChat returns IDs of users who are members of any chat of user
+func getUsersSharingChat(db *gorm.DB, userID uint) ([]uint, error) {
+	var userIDs []uint
+	tx := db.Table("chat_members").
+		Distinct("user_id").
+		Where("user_id <> ?", userID).
+		Where("chat_id IN (?)", db.Table("chat_members").Select("chat_id").Where("user_id = ?", userID)).
+		Pluck("user_id", &userIDs)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return userIDs, nil
+}
+
+// getUnreadCounts returns count of unread messages of others in every chat
+// user is a member of
+func getUnreadCounts(db *gorm.DB, userID uint) (map[uint]int64, error) {
+	var rows []struct {
+		ChatID      uint
+		UnreadCount int64
+	}
+	tx := db.Table("chat_members").
+		Select("chat_members.chat_id, COUNT(messages.id) AS unread_count").
+		Joins("LEFT JOIN messages ON messages.chat_id = chat_members.chat_id"+
+			" AND messages.id > chat_members.last_read_message_id"+
+			" AND messages.from_id <> chat_members.user_id"+
+			" AND messages.deleted_at IS NULL").
+		Where("chat_members.user_id = ?", userID).
+		Group("chat_members.chat_id").
+		Scan(&rows)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	unreadCounts := make(map[uint]int64, len(rows))
+	for _, row := range rows {
+		unreadCounts[row.ChatID] = row.UnreadCount
+	}
+	return unreadCounts, nil
+}
+
+const defaultMessagesPageSize = 50
+
+// MessagesPageQuery selects messages of chat with ID between After and Before,
+// both are exclusive and optional. Without After the newest messages are
+// selected
+type MessagesPageQuery struct {
+	Before uint `query:"before"`
+	After  uint `query:"after"`
+	Limit  int  `query:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+// getMessagesPage returns messages of chat selected by query ordered by ID and
+// whether there are more of them, older ones without After and newer ones
+// with it. Deleted messages are included without content, so they are shown as
+// placeholders
+func getMessagesPage(db *gorm.DB, chatID uint, query MessagesPageQuery) ([]Message, bool, error) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultMessagesPageSize
+	}
+
+	tx := db.Unscoped().Preload("From").Where("chat_id = ?", chatID)
+	if query.Before != 0 {
+		tx = tx.Where("id < ?", query.Before)
+	}
+	if query.After != 0 {
+		tx = tx.Where("id > ?", query.After).Order("id")
+	} else {
+		tx = tx.Order("id DESC")
+	}
+
+	// one more message tells whether there are more of them
+	var messages []Message
+	err := tx.Limit(limit + 1).Find(&messages).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if query.After == 0 {
+		slices.Reverse(messages)
+	}
+	for i := range messages {
+		if messages[i].DeletedAt.Valid {
+			messages[i].Content = ""
+		}
+	}
+	return messages, hasMore, nil
+}
+
+// getMessagesAfter returns up to limit messages of chat with ID greater than
+// afterID, the oldest first, and whether there are more of them. Unlike
+// `getMessagesPage`, zero afterID selects messages from the very first one.
+// Deleted messages are included, so that caller can skip them
+func getMessagesAfter(db *gorm.DB, chatID uint, afterID uint, limit int) ([]Message, bool, error) {
+	// one more message tells whether there are more of them
+	var messages []Message
+	err := db.Unscoped().
+		Preload("From").
+		Where("chat_id = ? AND id > ?", chatID, afterID).
+		Order("id").
+		Limit(limit + 1).
+		Find(&messages).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return messages, hasMore, nil
+}
+
+// getMessagesChangedSince returns up to limit messages of chat with ID up to
+// untilID that were edited or deleted after since, the oldest first, and
+// whether there are more of them
+func getMessagesChangedSince(db *gorm.DB, chatID uint, untilID uint, since time.Time, limit int) ([]Message, bool, error) {
+	// one more message tells whether there are more of them
+	var messages []Message
+	err := db.Unscoped().
+		Where("chat_id = ? AND id <= ?", chatID, untilID).
+		Where("edited_at > ? OR deleted_at > ?", since, since).
+		Order("id").
+		Limit(limit + 1).
+		Find(&messages).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return messages, hasMore, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// MarkReadRequestSchema is used by `mark_read` frame. All messages of chat up
+// to MessageID are marked read
+type MarkReadRequestSchema struct {
+	BaseMessageSchema
+
+	ChatID    uint
+	UserID    uint
+	MessageID uint
+}
+
+// ReadReceiptSchema is sent to other members of chat subscribed to it when
+// user reads messages of chat up to MessageID
+type ReadReceiptSchema struct {
+	BaseMessageSchema
+
+	ChatID    uint
+	UserID    uint
+	MessageID uint
+}
+
+// markChatRead marks messages of chat up to messageID read by user and tells
+// other members about it
+func markChatRead(ctx context.Context, db *gorm.DB, broker Broker, user *User, chatID uint, messageID uint) error {
+	err := requireChatMember(db, user, chatID)
+	if err != nil {
+		return err
+	}
+
+	isUpdated, err := markMessagesRead(db, user.ID, chatID, messageID)
+	if err != nil {
+		return err
+	}
+	// receipt for the message was sent already
+	if !isUpdated {
+		return nil
+	}
+
+	b, err := json.Marshal(ReadReceiptSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type: "read",
+		},
+		ChatID:    chatID,
+		UserID:    user.ID,
+		MessageID: messageID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshall ReadReceiptSchema")
+	}
+
+	userIDs, err := getChatUsersExcept(db, chatID, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "getChatUsersExcept")
+	}
+
+	return broker.Publish(ctx, ChatEvent{
+		ChatID:  chatID,
+		UserIDs: userIDs,
+		Message: b,
+	})
+}
+
+func handleMarkRead(db *gorm.DB, broker Broker, user *User, message []byte) error {
+	var requestData MarkReadRequestSchema
+	err := unmarshalFrame(message, &requestData)
+	if err != nil {
+		return err
+	}
+
+	err = requireFrameUser(user, requestData.UserID)
+	if err != nil {
+		return err
+	}
+
+	return markChatRead(context.Background(), db, broker, user, requestData.ChatID, requestData.MessageID)
+}
+
+// setChatsUnreadCount fills UnreadCount of chats user is a member of
+func setChatsUnreadCount(db *gorm.DB, user *User, chats []Chat) error {
+	unreadCounts, err := getUnreadCounts(db, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "getUnreadCounts")
+	}
+
+	for i := range chats {
+		unreadCount, ok := unreadCounts[chats[i].ID]
+		if ok {
+			chats[i].UnreadCount = &unreadCount
+		}
+	}
+	return nil
+}
@@ -9,28 +9,74 @@ func setupRoutes(app *fiber.App) {
 	app.Get("/", RootHandler)
 
 	api := app.Group("/api")
-	ui := app.Group("/ui")
+	ui := app.Group("/ui", CSRFMiddleware)
 
 	// TODO: rewrite UI endpoints to use API endpoints internally
 
+	// NOTE: public routes must be registered before authenticated groups, as
+	// group middleware applies to every route under its prefix registered
+	// after it
+
 	ui.Get("/login", LoginView)
 	ui.Post("/login", PostLoginView)
+	ui.Post("/login/2fa", PostTwoFactorView)
+	ui.Get("/signup", SignupView)
+	ui.Post("/signup", PostSignupView)
+	ui.Get("/verify-email", VerifyEmailView)
+	ui.Get("/forgot-password", ForgotPasswordView)
+	ui.Post("/forgot-password", PostForgotPasswordView)
+	ui.Get("/reset-password", ResetPasswordView)
+	ui.Post("/reset-password", PostResetPasswordView)
 	ui.Get("/chats", AllChatsView)
-	ui.Get("/chats/:chatID", ChatView)
-	ui.Get("/users/:userID/chats", UserChatsView)
 	ui.Get("/users", UsersView)
 	ui.Get("/users/:userID", UserView)
 	ui.Get("", HomeView)
 
+	authUI := ui.Group("", RequireUIAuthMiddleware)
+	authUI.Get("/chats/:chatID", ChatView)
+	authUI.Get("/users/:userID/chats", UserChatsView)
+
 	api.Post("/login", Login)
+	api.Post("/login/2fa", LoginTwoFactor)
+	api.Post("/signup", Signup)
+	api.Post("/token", IssueToken)
+	api.Post("/token/refresh", RefreshToken)
+	api.Post("/token/revoke", RevokeToken)
+	api.Post("/verify-email", VerifyEmail)
+	api.Post("/password-reset", RequestPasswordReset)
+	api.Post("/password-reset/confirm", ConfirmPasswordReset)
 	api.Get("/users", GetUsers)
 	api.Get("/users/:userID", GetUser)
-	api.Post("/users", CreateUser)
 	api.Get("/chats", GetChats)
 	api.Get("/chats/:chatID", GetChat)
-	api.Post("/chats/:chatID", SendMessage)
-	api.Post("/users/:userID/avatar", UploadUserAvatar)
-	api.Post("/chats/:chatId/users/", JoinChat)
+
+	authAPI := api.Group("", RequireAPIAuthMiddleware, APICSRFMiddleware)
+	authAPI.Post("/logout", Logout)
+	authAPI.Post("/verify-email/resend", ResendVerificationEmail)
+	authAPI.Post("/2fa/enroll", EnrollTwoFactor)
+	authAPI.Post("/2fa/confirm", ConfirmTwoFactor)
+	authAPI.Post("/2fa/disable", DisableTwoFactor)
+	authAPI.Get("/sessions", GetSessions)
+	authAPI.Delete("/sessions", RevokeOtherSessions)
+	authAPI.Delete("/sessions/:sessionID", RevokeSession)
+	authAPI.Post("/users", RequireSiteAdminMiddleware, CreateUser)
+	authAPI.Put("/users/:userID/admin", RequireSiteAdminMiddleware, SetUserAdmin)
+	authAPI.Delete("/users/:userID/login-lock", RequireSiteAdminMiddleware, UnlockUserLogin)
+	authAPI.Post("/users/:userID/avatar", UploadUserAvatar)
+	authAPI.Post("/chats", CreateChat)
+	authAPI.Post("/chats/:chatID", SendMessage)
+	authAPI.Post("/chats/:chatID/read", MarkChatRead)
+	authAPI.Get("/chats/:chatID/messages", GetChatMessages)
+	authAPI.Patch("/chats/:chatID", RenameChat)
+	authAPI.Delete("/chats/:chatID", DeleteChat)
+	authAPI.Post("/chats/:chatId/users/", JoinChat)
+	authAPI.Post("/chats/:chatID/users/:userID", AddChatMember)
+	authAPI.Delete("/chats/:chatID/users/:userID", RemoveChatMember)
+	authAPI.Put("/chats/:chatID/users/:userID/role", SetChatMemberRole)
+	authAPI.Patch("/chats/:chatID/messages/:messageID", EditChatMessage)
+	authAPI.Delete("/chats/:chatID/messages/:messageID", DeleteChatMessage)
 
 	app.Get("/ws", websocket.New(WebsocketHandler))
+	// fallback for clients whose proxies break websockets
+	app.Get("/sse", SameOriginMiddleware, RequireAPIAuthMiddleware, SSEHandler)
 }
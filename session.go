@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/fiber/v2/middleware/session"
 	"github.com/pkg/errors"
+	goredis "github.com/redis/go-redis/v9"
 )
 
 type SessionCurrentUser struct {
@@ -51,3 +56,242 @@ func getLoggedInUser(c *fiber.Ctx) (*SessionCurrentUser, error) {
 
 	return sessionCurrentUser, err
 }
+
+// getCurrentUser returns user resolved by `CurrentUserMiddleware`, nil for
+// anonymous requests
+func getCurrentUser(c *fiber.Ctx) *User {
+	user, _ := c.Locals("currentUser").(*User)
+	return user
+}
+
+// setSessionCurrentUser logs user in with a new session id, so that session
+// id known before login can not be reused, and registers the session in
+// `SessionRegistry`
+func setSessionCurrentUser(c *fiber.Ctx, session *session.Session, user *User) error {
+	registry, ok := c.Locals("sessions").(*SessionRegistry)
+	if !ok {
+		log.Fatal("error getting `sessions` from c.Locals()")
+	}
+
+	sessionCurrentUser := SessionCurrentUser{
+		ID:        user.ID,
+		Name:      user.Name,
+		Email:     user.Email,
+		AvatarURL: user.AvatarURL,
+	}
+	b, err := json.Marshal(sessionCurrentUser)
+	if err != nil {
+		return errors.Wrap(err, "json marshall sessionCurrentUser")
+	}
+
+	err = session.Regenerate()
+	if err != nil {
+		return errors.Wrap(err, "session regenerate()")
+	}
+
+	session.Delete(PendingTwoFactorKey)
+	session.Set(SessionCurrentUserKey, string(b))
+	sessionID := session.ID()
+	err = session.Save()
+	if err != nil {
+		return errors.Wrap(err, "session save()")
+	}
+
+	now := time.Now()
+	err = registry.Add(c.Context(), user.ID, SessionInfo{
+		ID:         sessionID,
+		Device:     c.Get(fiber.HeaderUserAgent),
+		IP:         c.IP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+const sessionExpiration = 24 * time.Hour
+
+// sessionRegistryExpiration is a bit longer than `sessionExpiration`, as
+// session data may be saved after registry entry is touched in the same
+// request. Entries outliving session data are pruned by `List`
+const sessionRegistryExpiration = sessionExpiration + time.Minute
+
+type SessionInfo struct {
+	ID         string
+	Device     string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// Current is set when listing sessions for the session of request
+	Current bool `json:",omitempty"`
+}
+
+// SessionRegistry keeps track of sessions of every user, so that they can be
+// listed and revoked. Session data itself is stored by `session.Store`
+type SessionRegistry struct {
+	redis   goredis.UniversalClient
+	storage fiber.Storage
+	broker  Broker
+}
+
+func NewSessionRegistry(redisClient goredis.UniversalClient, storage fiber.Storage, broker Broker) *SessionRegistry {
+	return &SessionRegistry{
+		redis:   redisClient,
+		storage: storage,
+		broker:  broker,
+	}
+}
+
+func (r *SessionRegistry) Add(ctx context.Context, userID uint, info SessionInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "json marshall SessionInfo")
+	}
+
+	_, err = r.redis.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Set(ctx, sessionInfoKey(info.ID), b, sessionRegistryExpiration)
+		pipe.SAdd(ctx, userSessionsKey(userID), info.ID)
+		pipe.Expire(ctx, userSessionsKey(userID), sessionRegistryExpiration)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "redis add session")
+	}
+
+	return nil
+}
+
+// Touch updates last seen time of session of user and extends its expiration.
+// Every save of session data extends it in `session.Store`, so registry has
+// to follow, otherwise session outlives its registry entry and can not be
+// revoked anymore
+func (r *SessionRegistry) Touch(ctx context.Context, userID uint, sessionID string) error {
+	info, err := r.get(ctx, sessionID)
+	if err != nil || info == nil {
+		return err
+	}
+
+	info.LastSeenAt = time.Now()
+	b, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "json marshall SessionInfo")
+	}
+
+	_, err = r.redis.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Set(ctx, sessionInfoKey(sessionID), b, sessionRegistryExpiration)
+		pipe.SAdd(ctx, userSessionsKey(userID), sessionID)
+		pipe.Expire(ctx, userSessionsKey(userID), sessionRegistryExpiration)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "redis touch session")
+	}
+
+	return nil
+}
+
+func (r *SessionRegistry) get(ctx context.Context, sessionID string) (*SessionInfo, error) {
+	b, err := r.redis.Get(ctx, sessionInfoKey(sessionID)).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "redis get session")
+	}
+
+	var info SessionInfo
+	err = json.Unmarshal(b, &info)
+	if err != nil {
+		return nil, errors.Wrap(err, "json unmarshall SessionInfo")
+	}
+	return &info, nil
+}
+
+// List returns active sessions of user, most recently seen first
+func (r *SessionRegistry) List(ctx context.Context, userID uint) ([]SessionInfo, error) {
+	sessionIDs, err := r.redis.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis get user sessions")
+	}
+
+	sessions := []SessionInfo{}
+	for _, sessionID := range sessionIDs {
+		info, err := r.get(ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+
+		if info != nil {
+			// session data may expire earlier, if it was not saved lately
+			data, err := r.storage.Get(sessionID)
+			if err != nil {
+				return nil, errors.Wrap(err, "get session data")
+			}
+			if data == nil {
+				info = nil
+			}
+		}
+
+		if info == nil {
+			// session expired
+			err = r.redis.SRem(ctx, userSessionsKey(userID), sessionID).Err()
+			if err != nil {
+				return nil, errors.Wrap(err, "redis remove expired session")
+			}
+			continue
+		}
+
+		sessions = append(sessions, *info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	return sessions, nil
+}
+
+// Revoke deletes session of user and closes websocket connections opened
+// with it on every instance. Returns `fiber.ErrNotFound` if user has no such session
+func (r *SessionRegistry) Revoke(ctx context.Context, userID uint, sessionID string) error {
+	isMember, err := r.redis.SIsMember(ctx, userSessionsKey(userID), sessionID).Result()
+	if err != nil {
+		return errors.Wrap(err, "redis check user session")
+	}
+	if !isMember {
+		return fiber.ErrNotFound
+	}
+
+	err = r.storage.Delete(sessionID)
+	if err != nil {
+		return errors.Wrap(err, "delete session data")
+	}
+
+	_, err = r.redis.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Del(ctx, sessionInfoKey(sessionID))
+		pipe.SRem(ctx, userSessionsKey(userID), sessionID)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "redis remove session")
+	}
+
+	err = r.broker.Publish(ctx, ChatEvent{
+		CloseSessionID: sessionID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "publish session close")
+	}
+
+	return nil
+}
+
+func sessionInfoKey(sessionID string) string {
+	return fmt.Sprintf("session_info:%s", sessionID)
+}
+
+func userSessionsKey(userID uint) string {
+	return fmt.Sprintf("user_sessions:%d", userID)
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 
-	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -34,16 +35,26 @@ func connectDatabase(DSN string) *gorm.DB {
 //go:embed templates/*
 var templatesFS embed.FS
 
-func createApp(pgDB *gorm.DB, redisDB *redis.Storage) *fiber.App {
+// createApp returns app and func that stops its background work, which is
+// also called on app shutdown
+func createApp(config *Config, pgDB *gorm.DB, redisDB *redis.Storage, mailer Mailer) (*fiber.App, func()) {
 	htmlEngine := html.NewFileSystem(http.FS(templatesFS), ".html")
 
 	app := fiber.New(fiber.Config{
 		AppName:     "GoChatApp",
 		Views:       htmlEngine,
 		ViewsLayout: "templates/layouts/base",
+		// lets middlewares pass values to every template, e.g. `.CSRFToken`
+		PassLocalsToViews: true,
+		// behind a proxy client IP is taken from its header, which is trusted
+		// only on connections of `TRUSTED_PROXIES` (space separated IPs or
+		// CIDRs), so clients can not forge it
+		ProxyHeader:             config.GetString("PROXY_HEADER"),
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          config.GetStringSlice("TRUSTED_PROXIES"),
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			log.Errorf("global error = %v\n", err.Error())
-			return c.Status(fiber.StatusBadRequest).JSON(GlobalErrorHandlerResponse{
+			return c.Status(getErrorStatusCode(err)).JSON(GlobalErrorHandlerResponse{
 				Success: false,
 				Message: err.Error(),
 			})
@@ -51,23 +62,68 @@ func createApp(pgDB *gorm.DB, redisDB *redis.Storage) *fiber.App {
 	})
 
 	app.Use(IndentJSONResponseMiddleware)
-	app.Use("/ws", AssertWebSocketUpgradeMiddleware)
+
+	validate := newValidator()
+	redisClient := redisDB.Conn()
+	tokenManager := NewTokenManager(getJWTSecret(config), redisClient)
+	appURL := getPublicURL(config)
+
+	// TODO: rename to `sessionStore` soon
+	store := session.New(session.Config{
+		Storage:        redisDB,
+		Expiration:     sessionExpiration,
+		CookieHTTPOnly: true,
+	})
+	hub := NewHub(getWebsocketTimeouts(config))
+	broker := getBroker(config, redisClient)
+	sessionRegistry := NewSessionRegistry(redisClient, redisDB, broker)
+	loginThrottle := NewLoginThrottle(redisClient)
+	presenceTracker := NewPresenceTracker(redisClient, hub.timeouts.IdleTimeout)
 
 	app.Use(func(c *fiber.Ctx) error {
-		validate := validator.New()
 		c.Locals("validate", validate)
 
-		// TODO: rename to `sessionStore` soon
-		var store = session.New(session.Config{
-			Storage: redisDB,
-		})
 		c.Locals("store", store)
 
+		c.Locals("sessions", sessionRegistry)
+
+		c.Locals("hub", hub)
+
+		c.Locals("broker", broker)
+
 		c.Locals("db", pgDB)
 
+		c.Locals("redis", redisClient)
+
+		c.Locals("tokens", tokenManager)
+
+		c.Locals("loginThrottle", loginThrottle)
+
+		c.Locals("presence", presenceTracker)
+
+		c.Locals("mailer", mailer)
+
+		c.Locals("appURL", appURL)
+
 		return c.Next()
 	})
 
+	// every instance delivers events of all instances to its own websocket
+	// connections
+	brokerCtx, cancelBroker := context.WithCancel(context.Background())
+	err := broker.Subscribe(brokerCtx, hub.Deliver)
+	if err != nil {
+		panic(fmt.Errorf("error subscribe to broker: %w", err))
+	}
+	app.Hooks().OnShutdown(func() error {
+		cancelBroker()
+		return nil
+	})
+
+	app.Use(CurrentUserMiddleware)
+
+	app.Use("/ws", SameOriginMiddleware, AssertWebSocketUpgradeMiddleware)
+
 	if !isTesting() {
 		app.Use(logger.New())
 	}
@@ -76,7 +132,38 @@ func createApp(pgDB *gorm.DB, redisDB *redis.Storage) *fiber.App {
 
 	setupRoutes(app)
 
-	return app
+	return app, cancelBroker
+}
+
+func getErrorStatusCode(err error) int {
+	var fiberError *fiber.Error
+	if errors.As(err, &fiberError) {
+		return fiberError.Code
+	}
+
+	var invalidCredentialsError *InvalidCredentialsError
+	var unauthorizedUserError *UnauthorizedUserError
+	var invalidTokenError *InvalidTokenError
+	var invalidTwoFactorCodeError *InvalidTwoFactorCodeError
+	if errors.As(err, &invalidCredentialsError) || errors.As(err, &unauthorizedUserError) || errors.As(err, &invalidTokenError) || errors.As(err, &invalidTwoFactorCodeError) {
+		return fiber.StatusUnauthorized
+	}
+
+	var tooManyLoginAttemptsError *TooManyLoginAttemptsError
+	if errors.As(err, &tooManyLoginAttemptsError) {
+		return fiber.StatusTooManyRequests
+	}
+
+	var forbiddenError *ForbiddenError
+	if errors.As(err, &forbiddenError) {
+		return fiber.StatusForbidden
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fiber.StatusNotFound
+	}
+
+	return fiber.StatusBadRequest
 }
 
 func isTesting() bool {
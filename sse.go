@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// sseRetry is reconnection delay sent to browser
+const sseRetry = 3 * time.Second
+
+// sseClientConn is `clientConn` of server-sent events stream. Events are the
+// same JSON frames as websocket ones. Events moving replay cursor of a chat
+// get cursors of all chats as event ID, see `formatSSEEventID`, so browser
+// resumes stream of every chat after the last message it got
+type sseClientConn struct {
+	w *bufio.Writer
+	// lastMessageIDs is ID of the last message sent by chat ID. Messages of
+	// different chats may be published out of ID order, so one cursor for all
+	// chats could skip some of them
+	lastMessageIDs map[uint]uint
+	// onPing is called once ping is written, as stream has no pongs
+	onPing func()
+}
+
+func (c *sseClientConn) WriteMessage(message []byte) error {
+	var frame struct {
+		Type          string
+		ChatID        uint
+		MessageID     uint
+		LastMessageID uint
+	}
+	err := json.Unmarshal(message, &frame)
+	if err != nil {
+		return errors.Wrap(err, "json unmarshall frame")
+	}
+
+	// replay skips deleted messages, so its end moves cursor too
+	messageID := frame.MessageID
+	if frame.Type == "replay_done" {
+		messageID = frame.LastMessageID
+	}
+	isCursorMoved := frame.Type == "new_message" || frame.Type == "replay_done"
+	if isCursorMoved && messageID > c.lastMessageIDs[frame.ChatID] {
+		c.lastMessageIDs[frame.ChatID] = messageID
+		_, err = fmt.Fprintf(c.w, "id: %s\n", formatSSEEventID(c.lastMessageIDs))
+		if err != nil {
+			return errors.Wrap(err, "write event id")
+		}
+	}
+
+	_, err = fmt.Fprintf(c.w, "data: %s\n\n", message)
+	if err != nil {
+		return errors.Wrap(err, "write event data")
+	}
+	return c.w.Flush()
+}
+
+func (c *sseClientConn) WritePing() error {
+	_, err := c.w.WriteString(": ping\n\n")
+	if err != nil {
+		return errors.Wrap(err, "write ping")
+	}
+
+	err = c.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if c.onPing != nil {
+		c.onPing()
+	}
+	return nil
+}
+
+// formatSSEEventID formats ID of the last message of every chat as
+// `chatID:messageID` pairs separated by commas, ordered by chat ID
+func formatSSEEventID(lastMessageIDs map[uint]uint) string {
+	chatIDs := make([]uint, 0, len(lastMessageIDs))
+	for chatID := range lastMessageIDs {
+		chatIDs = append(chatIDs, chatID)
+	}
+	slices.Sort(chatIDs)
+
+	cursors := make([]string, len(chatIDs))
+	for i, chatID := range chatIDs {
+		cursors[i] = fmt.Sprintf("%d:%d", chatID, lastMessageIDs[chatID])
+	}
+	return strings.Join(cursors, ",")
+}
+
+// parseSSEEventID parses event ID formatted by `formatSSEEventID`
+func parseSSEEventID(eventID string) (map[uint]uint, error) {
+	lastMessageIDs := map[uint]uint{}
+	for _, cursor := range strings.Split(eventID, ",") {
+		chatIDValue, messageIDValue, ok := strings.Cut(cursor, ":")
+		if !ok {
+			return nil, errors.Errorf("cursor %q is not chatID:messageID", cursor)
+		}
+
+		chatID, err := strconv.ParseUint(chatIDValue, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse chat id")
+		}
+		messageID, err := strconv.ParseUint(messageIDValue, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse message id")
+		}
+		lastMessageIDs[uint(chatID)] = uint(messageID)
+	}
+	return lastMessageIDs, nil
+}
+
+// WriteClose does nothing, as stream can be written only by writer goroutine.
+// Stream is ended once client is closed
+func (c *sseClientConn) WriteClose(closeCode int, reason string) error {
+	return nil
+}
+
+func (c *sseClientConn) Close() error {
+	return nil
+}
+
+// SSEHandler streams events of `WebsocketHandler` to clients that can not
+// open websocket, e.g. behind proxies that break it. Chats are subscribed by
+// `chatID` query params. If `Last-Event-ID` header or `lastEventID` query
+// param is set, messages of every chat after its last message in it are
+// replayed first, chats missing in it are not replayed.
+// Edits and deletes of already shown messages are not replayed, as stream
+// has no time to replay them from, they are shown after page reload
+func SSEHandler(c *fiber.Ctx) error {
+	db, ok := c.Locals("db").(*gorm.DB)
+	if !ok {
+		log.Fatal("error getting `db` from c.Locals()")
+	}
+
+	hub, ok := c.Locals("hub").(*Hub)
+	if !ok {
+		log.Fatal("error getting `hub` from c.Locals()")
+	}
+
+	broker, ok := c.Locals("broker").(Broker)
+	if !ok {
+		log.Fatal("error getting `broker` from c.Locals()")
+	}
+
+	presenceTracker, ok := c.Locals("presence").(*PresenceTracker)
+	if !ok {
+		log.Fatal("error getting `presence` from c.Locals()")
+	}
+
+	user := getCurrentUser(c)
+
+	var chatIDs []uint
+	for _, value := range c.Context().QueryArgs().PeekMulti("chatID") {
+		chatID, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "chatID must be a number")
+		}
+
+		err = requireChatMember(db, user, uint(chatID))
+		if err != nil {
+			return err
+		}
+		chatIDs = append(chatIDs, uint(chatID))
+	}
+
+	lastEventID := c.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventID")
+	}
+	lastMessageIDs := map[uint]uint{}
+	if lastEventID != "" {
+		cursors, err := parseSSEEventID(lastEventID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Last-Event-ID must be chatID:messageID pairs")
+		}
+		// cursors of chats that are not subscribed anymore are dropped
+		for _, chatID := range chatIDs {
+			if messageID, ok := cursors[chatID]; ok {
+				lastMessageIDs[chatID] = messageID
+			}
+		}
+	}
+
+	clientID, err := generateRandomToken()
+	if err != nil {
+		return err
+	}
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	// stops nginx from buffering the stream
+	c.Set("X-Accel-Buffering", "no")
+
+	// writer runs after handler returns, so it must not use `c`
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		conn := &sseClientConn{
+			w:              w,
+			lastMessageIDs: maps.Clone(lastMessageIDs),
+		}
+		client := newClient(clientID, conn, user.ID, sessionID, hub.timeouts)
+		conn.onPing = func() {
+			updatePresence(db, broker, presenceTracker, user, func(ctx context.Context) error {
+				return presenceTracker.Heartbeat(ctx, user.ID, client.id)
+			})
+		}
+
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Infof("write sse retry err=%s\n", err)
+			return
+		}
+
+		hub.Register(client)
+		updatePresence(db, broker, presenceTracker, user, func(ctx context.Context) error {
+			return presenceTracker.Connect(ctx, user.ID, client.id)
+		})
+		defer func() {
+			hub.Unregister(client)
+			updatePresence(db, broker, presenceTracker, user, func(ctx context.Context) error {
+				return presenceTracker.Disconnect(ctx, user.ID, client.id)
+			})
+		}()
+
+		// replay waits for writer, so it runs in its own goroutine
+		go func() {
+			for _, chatID := range chatIDs {
+				lastMessageID, ok := lastMessageIDs[chatID]
+				if !ok {
+					hub.Subscribe(client, chatID)
+					continue
+				}
+
+				hub.StartReplay(client, chatID)
+				lastReplayedMessageID, err := replayMessages(db, client, SubscribeRequestSchema{
+					ChatID:        chatID,
+					LastMessageID: &lastMessageID,
+				})
+				hub.FinishReplay(client, chatID, lastReplayedMessageID)
+				if err != nil {
+					log.Errorf("sse replay userID=%d err=%s\n", user.ID, err)
+					client.close()
+					return
+				}
+			}
+		}()
+
+		client.writePump()
+	})
+
+	return nil
+}
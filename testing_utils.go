@@ -4,21 +4,32 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 
 	"net/http"
 	"net/http/httptest"
 	"os/exec"
+	"regexp"
 	"strings"
 	"testing"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/fiber/v2/utils"
+	"github.com/gorilla/websocket"
 	"gorm.io/gorm"
 )
 
 // setupTest sets up fiber's App and DB
 func setupTest(t *testing.T) (*fiber.App, *gorm.DB, func()) {
+	app, db, _, teardownTest := setupTestWithOutbox(t)
+	return app, db, teardownTest
+}
+
+// setupTestWithOutbox is `setupTest` that also returns outbox with mails sent
+// by the app
+func setupTestWithOutbox(t *testing.T) (*fiber.App, *gorm.DB, *OutboxMailer, func()) {
 	config := NewConfig("test_config")
 	db, clearDB := prepareTestDb(t, config)
 
@@ -26,13 +37,17 @@ func setupTest(t *testing.T) (*fiber.App, *gorm.DB, func()) {
 
 	redisDB := getRedis(config)
 
-	app := createApp(db, redisDB)
+	outbox := NewOutboxMailer("")
+
+	app, stopApp := createApp(config, db, redisDB, outbox)
 
 	// TODO: teardown func that is returned should be called using t.Cleanup(teardownTest). it's better than `defer`
 
-	return app, db, func() {
+	return app, db, outbox, func() {
 		// TODO: errors in this func should not affect next functions. how to do that?
 
+		stopApp()
+
 		err := clearDB(db)
 		if err != nil {
 			t.Error(err)
@@ -46,7 +61,7 @@ func setupTest(t *testing.T) (*fiber.App, *gorm.DB, func()) {
 }
 
 func clearDB(db *gorm.DB) error {
-	tables := []string{"messages", "chat_members", "chats", "users"}
+	tables := []string{"recovery_codes", "message_revisions", "messages", "chat_members", "chats", "users"}
 	for _, table := range tables {
 		tx := db.Exec(fmt.Sprintf("DELETE FROM %s", table))
 		if tx.Error != nil {
@@ -98,6 +113,11 @@ func getLoggedInUserSessionCookie(t *testing.T, app *fiber.App, user User) *http
 	utils.AssertEqual(t, nil, err)
 	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "Status code")
 
+	return getSessionCookie(resp)
+}
+
+// getSessionCookie returns session cookie set by response, nil if there is none
+func getSessionCookie(resp *http.Response) *http.Cookie {
 	cookies := resp.Cookies()
 	var sessionCookie *http.Cookie
 	for i := 0; i < len(cookies); i += 1 {
@@ -108,3 +128,117 @@ func getLoggedInUserSessionCookie(t *testing.T, app *fiber.App, user User) *http
 
 	return sessionCookie
 }
+
+func getUserTokens(t *testing.T, app *fiber.App, user User) TokenPair {
+	loginData := LoginRequestSchema{
+		Email:    user.Email,
+		Password: user.Password,
+	}
+	b, err := json.Marshal(loginData)
+	utils.AssertEqual(t, nil, err)
+
+	req := httptest.NewRequest(fiber.MethodPost, "/api/token", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "Status code")
+
+	var tokens TokenPair
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	utils.AssertEqual(t, nil, err)
+
+	return tokens
+}
+
+var mailTokenRegexp = regexp.MustCompile(`token=(\S+)`)
+
+// getMailToken returns token from link in the last mail sent to address
+func getMailToken(t *testing.T, outbox *OutboxMailer, to string) string {
+	mail := outbox.LastMailTo(to)
+	if mail == nil {
+		t.Fatalf("no mail sent to %s", to)
+	}
+
+	match := mailTokenRegexp.FindStringSubmatch(mail.Body)
+	if match == nil {
+		t.Fatalf("no token in mail body=%s", mail.Body)
+	}
+	return match[1]
+}
+
+// getAPICSRFToken returns CSRF token of session, which API requests that
+// change state and are authenticated by session cookie must send
+func getAPICSRFToken(t *testing.T, app *fiber.App, cookie *http.Cookie) string {
+	req := httptest.NewRequest(fiber.MethodGet, "/api/sessions", nil)
+	req.AddCookie(cookie)
+	resp, err := app.Test(req)
+	utils.AssertEqual(t, nil, err)
+
+	return resp.Header.Get(CSRFTokenHeader)
+}
+
+var csrfTokenRegexp = regexp.MustCompile(`name="csrf_token"\s+value="([^"]+)"`)
+
+// getCSRFToken opens login page and returns CSRF token from its form together
+// with session cookie the token belongs to
+func getCSRFToken(t *testing.T, app *fiber.App) (string, *http.Cookie) {
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/ui/login", nil))
+	utils.AssertEqual(t, nil, err)
+	utils.AssertEqual(t, fiber.StatusOK, resp.StatusCode, "Status code")
+
+	body, err := io.ReadAll(resp.Body)
+	utils.AssertEqual(t, nil, err)
+
+	match := csrfTokenRegexp.FindSubmatch(body)
+	if match == nil {
+		t.Fatalf("no CSRF token in body=%s", body)
+	}
+
+	return string(match[1]), getSessionCookie(resp)
+}
+
+// startTestServer serves app on random local port. It is needed for websocket
+// tests, as `app.Test` does not support connection upgrade
+func startTestServer(t *testing.T, app *fiber.App) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.AssertEqual(t, nil, err)
+
+	go func() {
+		_ = app.Listener(ln)
+	}()
+	t.Cleanup(func() {
+		_ = app.Shutdown()
+	})
+
+	return ln.Addr().String()
+}
+
+func dialWebsocket(addr string, cookie *http.Cookie) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	if cookie != nil {
+		header.Set("Cookie", fmt.Sprintf("%s=%s", cookie.Name, cookie.Value))
+	}
+	return websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", addr), header)
+}
+
+// readWebsocketJSON reads the next frame into v, skipping `presence` frames
+// which are sent whenever users sharing a chat connect or disconnect
+func readWebsocketJSON(conn *websocket.Conn, v any) error {
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var frame BaseMessageSchema
+		err = json.Unmarshal(message, &frame)
+		if err != nil {
+			return err
+		}
+		if frame.Type == "presence" {
+			continue
+		}
+
+		return json.Unmarshal(message, v)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const accessTokenTTL = 15 * time.Minute
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	TokenType    string
+	// ExpiresIn is lifetime of access token in seconds
+	ExpiresIn int
+}
+
+type AccessTokenClaims struct {
+	jwt.RegisteredClaims
+}
+
+func (c *AccessTokenClaims) UserID() (uint, error) {
+	userID, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parse subject")
+	}
+	return uint(userID), nil
+}
+
+type refreshTokenData struct {
+	UserID   uint
+	FamilyID string
+}
+
+// TokenManager issues JWT access tokens and opaque refresh tokens. Refresh
+// tokens are single-use: every refresh returns a new pair and belongs to the
+// same family as the used token. Presenting an already used refresh token
+// revokes the whole family, as it means the token was stolen
+type TokenManager struct {
+	secret []byte
+	redis  goredis.UniversalClient
+}
+
+func NewTokenManager(secret []byte, redisClient goredis.UniversalClient) *TokenManager {
+	return &TokenManager{
+		secret: secret,
+		redis:  redisClient,
+	}
+}
+
+func (m *TokenManager) IssueTokens(ctx context.Context, userID uint) (*TokenPair, error) {
+	return m.issueTokens(ctx, userID, uuid.NewString())
+}
+
+func (m *TokenManager) issueTokens(ctx context.Context, userID uint, familyID string) (*TokenPair, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+	claims := AccessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign access token")
+	}
+
+	refreshToken, err := generateRandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(refreshTokenData{
+		UserID:   userID,
+		FamilyID: familyID,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshall refreshTokenData")
+	}
+
+	tokenHash := hashToken(refreshToken)
+	_, err = m.redis.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Set(ctx, refreshTokenKey(tokenHash), b, refreshTokenTTL)
+		pipe.SAdd(ctx, refreshTokenFamilyKey(familyID), tokenHash)
+		pipe.Expire(ctx, refreshTokenFamilyKey(familyID), refreshTokenTTL)
+
+		// tokens of user are tracked, so they can be revoked all at once
+		pipe.SAdd(ctx, userRefreshTokenFamiliesKey(userID), familyID)
+		pipe.Expire(ctx, userRefreshTokenFamiliesKey(userID), refreshTokenTTL)
+		pipe.ZAdd(ctx, userAccessTokensKey(userID), goredis.Z{
+			Score:  float64(expiresAt.Unix()),
+			Member: claims.ID,
+		})
+		pipe.ZRemRangeByScore(ctx, userAccessTokensKey(userID), "-inf", strconv.FormatInt(now.Unix(), 10))
+		pipe.Expire(ctx, userAccessTokensKey(userID), accessTokenTTL)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "redis save refresh token")
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Refresh exchanges refresh token for a new token pair
+func (m *TokenManager) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	tokenHash := hashToken(refreshToken)
+
+	b, err := m.redis.GetDel(ctx, refreshTokenKey(tokenHash)).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		familyID, err := m.redis.Get(ctx, usedRefreshTokenKey(tokenHash)).Result()
+		if err == nil {
+			err = m.revokeFamily(ctx, familyID)
+			if err != nil {
+				return nil, err
+			}
+		} else if !errors.Is(err, goredis.Nil) {
+			return nil, errors.Wrap(err, "redis get used refresh token")
+		}
+		return nil, &InvalidTokenError{}
+	} else if err != nil {
+		return nil, errors.Wrap(err, "redis get refresh token")
+	}
+
+	var data refreshTokenData
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, errors.Wrap(err, "json unmarshall refreshTokenData")
+	}
+
+	err = m.redis.Set(ctx, usedRefreshTokenKey(tokenHash), data.FamilyID, refreshTokenTTL).Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis mark refresh token used")
+	}
+
+	return m.issueTokens(ctx, data.UserID, data.FamilyID)
+}
+
+// RevokeRefreshToken revokes refresh token and every token rotated from the
+// same login
+func (m *TokenManager) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	b, err := m.redis.Get(ctx, refreshTokenKey(hashToken(refreshToken))).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "redis get refresh token")
+	}
+
+	var data refreshTokenData
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return errors.Wrap(err, "json unmarshall refreshTokenData")
+	}
+
+	return m.revokeFamily(ctx, data.FamilyID)
+}
+
+func (m *TokenManager) revokeFamily(ctx context.Context, familyID string) error {
+	tokenHashes, err := m.redis.SMembers(ctx, refreshTokenFamilyKey(familyID)).Result()
+	if err != nil {
+		return errors.Wrap(err, "redis get refresh token family")
+	}
+
+	keys := []string{refreshTokenFamilyKey(familyID)}
+	for _, tokenHash := range tokenHashes {
+		keys = append(keys, refreshTokenKey(tokenHash))
+	}
+
+	err = m.redis.Del(ctx, keys...).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis delete refresh token family")
+	}
+
+	return nil
+}
+
+// RevokeAccessToken denies access token until it expires
+func (m *TokenManager) RevokeAccessToken(ctx context.Context, claims *AccessTokenClaims) error {
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+
+	err := m.redis.Set(ctx, revokedAccessTokenKey(claims.ID), 1, ttl).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis revoke access token")
+	}
+	return nil
+}
+
+// RevokeUserTokens revokes every refresh token family and every unexpired
+// access token of user, e.g. once password is reset
+func (m *TokenManager) RevokeUserTokens(ctx context.Context, userID uint) error {
+	familyIDs, err := m.redis.SMembers(ctx, userRefreshTokenFamiliesKey(userID)).Result()
+	if err != nil {
+		return errors.Wrap(err, "redis get user refresh token families")
+	}
+	for _, familyID := range familyIDs {
+		err = m.revokeFamily(ctx, familyID)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	accessTokens, err := m.redis.ZRangeByScoreWithScores(ctx, userAccessTokensKey(userID), &goredis.ZRangeBy{
+		Min: strconv.FormatInt(now.Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return errors.Wrap(err, "redis get user access tokens")
+	}
+
+	_, err = m.redis.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for _, accessToken := range accessTokens {
+			// token is denied a second longer, as expiry is in seconds
+			ttl := time.Unix(int64(accessToken.Score), 0).Sub(now) + time.Second
+			pipe.Set(ctx, revokedAccessTokenKey(accessToken.Member.(string)), 1, ttl)
+		}
+		pipe.Del(ctx, userRefreshTokenFamiliesKey(userID), userAccessTokensKey(userID))
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "redis revoke user tokens")
+	}
+	return nil
+}
+
+// ParseAccessToken validates access token and returns its claims, or
+// `InvalidTokenError` for expired, malformed or revoked tokens
+func (m *TokenManager) ParseAccessToken(ctx context.Context, accessToken string) (*AccessTokenClaims, error) {
+	var claims AccessTokenClaims
+	_, err := jwt.ParseWithClaims(accessToken, &claims, func(token *jwt.Token) (any, error) {
+		return m.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, &InvalidTokenError{}
+	}
+
+	revokedCount, err := m.redis.Exists(ctx, revokedAccessTokenKey(claims.ID)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis check revoked access token")
+	}
+	if revokedCount > 0 {
+		return nil, &InvalidTokenError{}
+	}
+
+	return &claims, nil
+}
+
+func generateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "rand read")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is used to not store tokens in redis as is
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func refreshTokenKey(tokenHash string) string {
+	return fmt.Sprintf("refresh_token:%s", tokenHash)
+}
+
+func usedRefreshTokenKey(tokenHash string) string {
+	return fmt.Sprintf("used_refresh_token:%s", tokenHash)
+}
+
+func refreshTokenFamilyKey(familyID string) string {
+	return fmt.Sprintf("refresh_token_family:%s", familyID)
+}
+
+func revokedAccessTokenKey(tokenID string) string {
+	return fmt.Sprintf("revoked_access_token:%s", tokenID)
+}
+
+func userRefreshTokenFamiliesKey(userID uint) string {
+	return fmt.Sprintf("user_refresh_token_families:%d", userID)
+}
+
+func userAccessTokensKey(userID uint) string {
+	return fmt.Sprintf("user_access_tokens:%d", userID)
+}
+
+const (
+	OneTimeTokenEmailVerification = "email_verification"
+	OneTimeTokenPasswordReset     = "password_reset"
+)
+
+// IssueOneTimeToken returns token for user that can be consumed only once
+// for given purpose before it expires
+func (m *TokenManager) IssueOneTimeToken(ctx context.Context, purpose string, userID uint, ttl time.Duration) (string, error) {
+	token, err := generateRandomToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = m.redis.Set(ctx, oneTimeTokenKey(purpose, hashToken(token)), userID, ttl).Err()
+	if err != nil {
+		return "", errors.Wrap(err, "redis save one-time token")
+	}
+
+	return token, nil
+}
+
+// ConsumeOneTimeToken returns id of user token was issued for and deletes the
+// token, or `InvalidTokenError` if token is unknown, used or expired
+func (m *TokenManager) ConsumeOneTimeToken(ctx context.Context, purpose string, token string) (uint, error) {
+	userID, err := m.redis.GetDel(ctx, oneTimeTokenKey(purpose, hashToken(token))).Uint64()
+	if errors.Is(err, goredis.Nil) {
+		return 0, &InvalidTokenError{}
+	} else if err != nil {
+		return 0, errors.Wrap(err, "redis get one-time token")
+	}
+
+	return uint(userID), nil
+}
+
+func oneTimeTokenKey(purpose, tokenHash string) string {
+	return fmt.Sprintf("one_time_token:%s:%s", purpose, tokenHash)
+}
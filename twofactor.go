@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/pkg/errors"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	goredis "github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const totpIssuer = "GoChatApp"
+const recoveryCodesCount = 10
+const pendingTwoFactorTTL = 5 * time.Minute
+
+// PendingTwoFactorKey holds user who passed password check, but did not enter
+// second factor yet. Such session is not authenticated
+var PendingTwoFactorKey = "PendingTwoFactor"
+
+type RecoveryCode struct {
+	ID uint `gorm:"primaryKey"`
+
+	UserID uint `gorm:"index"`
+
+	CodeHash string
+	UsedAt   *time.Time
+}
+
+type TwoFactorEnrollment struct {
+	Secret          string
+	ProvisioningURI string
+	// QRCode is PNG image of ProvisioningURI as data URI
+	QRCode string
+}
+
+func generateTOTPKey(user *User) (*TwoFactorEnrollment, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "totp generate")
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, errors.Wrap(err, "totp key image")
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return nil, errors.Wrap(err, "png encode")
+	}
+
+	return &TwoFactorEnrollment{
+		Secret:          key.Secret(),
+		ProvisioningURI: key.URL(),
+		QRCode:          "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+// validateTOTPCode checks code against secret. Every code is accepted only
+// once for user, so that intercepted code can not be replayed
+func validateTOTPCode(ctx context.Context, redisClient goredis.UniversalClient, userID uint, secret, code string) (bool, error) {
+	isValid, err := totp.ValidateCustom(code, secret, time.Now(), totp.ValidateOpts{
+		Period:    30,
+		Skew:      1,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil || !isValid {
+		return false, nil
+	}
+
+	isFirstUse, err := redisClient.SetNX(ctx, usedTOTPCodeKey(userID, code), 1, 3*30*time.Second).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "redis mark totp code used")
+	}
+	return isFirstUse, nil
+}
+
+// validateTwoFactorCode accepts either TOTP code or unused recovery code
+func validateTwoFactorCode(ctx context.Context, db *gorm.DB, redisClient goredis.UniversalClient, user *User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	isValid, err := validateTOTPCode(ctx, redisClient, user.ID, user.TOTPSecret, code)
+	if err != nil || isValid {
+		return isValid, err
+	}
+
+	return useRecoveryCode(db, user.ID, code)
+}
+
+func useRecoveryCode(db *gorm.DB, userID uint, code string) (bool, error) {
+	tx := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normalizeRecoveryCode(code))).
+		Update("UsedAt", time.Now())
+	if tx.Error != nil {
+		return false, errors.Wrap(tx.Error, "Update recovery code")
+	}
+	return tx.RowsAffected == 1, nil
+}
+
+// generateRecoveryCodes replaces recovery codes of user with new ones
+func generateRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	recoveryCodes := make([]RecoveryCode, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "rand read")
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = fmt.Sprintf("%s-%s", code[:4], code[4:])
+		recoveryCodes[i] = RecoveryCode{
+			UserID:   userID,
+			CodeHash: hashToken(normalizeRecoveryCode(codes[i])),
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return errors.Wrap(err, "Delete recovery codes")
+		}
+
+		err = tx.Create(&recoveryCodes).Error
+		if err != nil {
+			return errors.Wrap(err, "Create recovery codes")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// startLogin logs user in right away if user has no second factor or code is
+// valid. If second factor is required and code is empty, session is left
+// half-authenticated and true is returned. User previously logged in with
+// the session is logged out then, so that browser is not authenticated as
+// them while second factor of another user is pending
+func startLogin(c *fiber.Ctx, db *gorm.DB, session *session.Session, user *User, code string) (bool, error) {
+	if !user.TOTPEnabled {
+		return false, setSessionCurrentUser(c, session, user)
+	}
+
+	if code == "" {
+		session.Delete(SessionCurrentUserKey)
+		err := session.Regenerate()
+		if err != nil {
+			return false, errors.Wrap(err, "session regenerate()")
+		}
+
+		session.Set(PendingTwoFactorKey, fmt.Sprintf("%d:%d", user.ID, time.Now().Add(pendingTwoFactorTTL).Unix()))
+		err = session.Save()
+		if err != nil {
+			return false, errors.Wrap(err, "session save()")
+		}
+		return true, nil
+	}
+
+	err := requireTwoFactorCode(c, db, user, code)
+	if err != nil {
+		return false, err
+	}
+
+	return false, setSessionCurrentUser(c, session, user)
+}
+
+// requireTwoFactorCode returns `InvalidTwoFactorCodeError` if user has second
+// factor enabled and code is not valid
+func requireTwoFactorCode(c *fiber.Ctx, db *gorm.DB, user *User, code string) error {
+	if !user.TOTPEnabled {
+		return nil
+	}
+
+	redisClient, ok := c.Locals("redis").(goredis.UniversalClient)
+	if !ok {
+		log.Fatal("error getting `redis` from c.Locals()")
+	}
+
+	throttle, ok := c.Locals("loginThrottle").(*LoginThrottle)
+	if !ok {
+		log.Fatal("error getting `loginThrottle` from c.Locals()")
+	}
+
+	// codes are short, so guessing them is throttled as passwords are
+	err := checkLoginThrottle(c, throttle, user.Email)
+	if err != nil {
+		return err
+	}
+
+	isValid, err := validateTwoFactorCode(c.Context(), db, redisClient, user, code)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		err = throttle.RegisterFailure(c.Context(), user.Email, c.IP())
+		if err != nil {
+			return err
+		}
+		return &InvalidTwoFactorCodeError{}
+	}
+
+	return throttle.RegisterSuccess(c.Context(), user.Email)
+}
+
+// getPendingTwoFactorUser returns user of half-authenticated session, or
+// `UnauthorizedUserError` if there is none or it has expired
+func getPendingTwoFactorUser(db *gorm.DB, session *session.Session) (*User, error) {
+	val, ok := session.Get(PendingTwoFactorKey).(string)
+	if !ok {
+		return nil, &UnauthorizedUserError{}
+	}
+
+	var userID uint
+	var expiresAt int64
+	_, err := fmt.Sscanf(val, "%d:%d", &userID, &expiresAt)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, &UnauthorizedUserError{}
+	}
+
+	var user User
+	err = db.First(&user, userID).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Get user by id")
+	}
+
+	return &user, nil
+}
+
+func usedTOTPCodeKey(userID uint, code string) string {
+	return fmt.Sprintf("used_totp_code:%d:%s", userID, code)
+}
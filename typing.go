@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// typing_start is broadcast at most once per `typingThrottleInterval` for
+// client and chat, later ones only extend indicator. Indicator expires after
+// `typingIndicatorTTL` without typing_start
+const typingThrottleInterval = 2 * time.Second
+const typingIndicatorTTL = 5 * time.Second
+
+// TypingRequestSchema is used by `typing_start` and `typing_stop` frames
+type TypingRequestSchema struct {
+	BaseMessageSchema
+
+	ChatID uint
+	UserID uint
+}
+
+// TypingSchema is sent to other members of chat subscribed to it when user
+// starts or stops typing
+type TypingSchema struct {
+	BaseMessageSchema
+
+	ChatID    uint
+	UserID    uint
+	UserName  string
+	UserEmail string
+	IsTyping  bool
+}
+
+// typingIndicators of client by chat. Indicators are updated by read loop of
+// client and removed by their expiry timers
+type typingIndicators struct {
+	mu    sync.Mutex
+	chats map[uint]*typingIndicator
+}
+
+type typingIndicator struct {
+	broadcastAt time.Time
+	expiry      *time.Timer
+}
+
+func newTypingIndicators() *typingIndicators {
+	return &typingIndicators{
+		chats: map[uint]*typingIndicator{},
+	}
+}
+
+func handleTyping(db *gorm.DB, broker Broker, client *Client, user *User, message []byte, isTyping bool) error {
+	var requestData TypingRequestSchema
+	err := unmarshalFrame(message, &requestData)
+	if err != nil {
+		return err
+	}
+
+	err = requireFrameUser(user, requestData.UserID)
+	if err != nil {
+		return err
+	}
+
+	if isTyping {
+		return startTyping(db, broker, client, user, requestData.ChatID)
+	}
+	return stopTyping(db, broker, client, user, requestData.ChatID)
+}
+
+func startTyping(db *gorm.DB, broker Broker, client *Client, user *User, chatID uint) error {
+	indicators := client.typing
+
+	indicators.mu.Lock()
+	defer indicators.mu.Unlock()
+
+	indicator := indicators.chats[chatID]
+	if indicator != nil && time.Since(indicator.broadcastAt) < typingThrottleInterval {
+		indicator.expiry.Reset(typingIndicatorTTL)
+		return nil
+	}
+
+	err := requireChatMember(db, user, chatID)
+	if err != nil {
+		return err
+	}
+
+	err = publishTyping(context.Background(), db, broker, user, chatID, true)
+	if err != nil {
+		return err
+	}
+
+	if indicator != nil {
+		indicator.broadcastAt = time.Now()
+		indicator.expiry.Reset(typingIndicatorTTL)
+		return nil
+	}
+
+	indicator = &typingIndicator{
+		broadcastAt: time.Now(),
+	}
+	indicator.expiry = time.AfterFunc(typingIndicatorTTL, func() {
+		indicators.mu.Lock()
+		defer indicators.mu.Unlock()
+
+		// indicator was stopped or replaced meanwhile
+		if indicators.chats[chatID] != indicator {
+			return
+		}
+		delete(indicators.chats, chatID)
+
+		err := publishTyping(context.Background(), db, broker, user, chatID, false)
+		if err != nil {
+			log.Errorf("publish typing expiry userID=%d err=%s\n", user.ID, err)
+		}
+	})
+	indicators.chats[chatID] = indicator
+
+	return nil
+}
+
+func stopTyping(db *gorm.DB, broker Broker, client *Client, user *User, chatID uint) error {
+	indicators := client.typing
+
+	indicators.mu.Lock()
+	defer indicators.mu.Unlock()
+
+	indicator := indicators.chats[chatID]
+	if indicator == nil {
+		return nil
+	}
+	indicator.expiry.Stop()
+	delete(indicators.chats, chatID)
+
+	return publishTyping(context.Background(), db, broker, user, chatID, false)
+}
+
+// stopAllTyping stops indicators of client, it is called once connection is
+// closed
+func stopAllTyping(db *gorm.DB, broker Broker, client *Client, user *User) {
+	client.typing.mu.Lock()
+	chatIDs := make([]uint, 0, len(client.typing.chats))
+	for chatID := range client.typing.chats {
+		chatIDs = append(chatIDs, chatID)
+	}
+	client.typing.mu.Unlock()
+
+	for _, chatID := range chatIDs {
+		err := stopTyping(db, broker, client, user, chatID)
+		if err != nil {
+			log.Errorf("stop typing userID=%d err=%s\n", user.ID, err)
+		}
+	}
+}
+
+func publishTyping(ctx context.Context, db *gorm.DB, broker Broker, user *User, chatID uint, isTyping bool) error {
+	b, err := json.Marshal(TypingSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type: "typing",
+		},
+		ChatID:    chatID,
+		UserID:    user.ID,
+		UserName:  user.Name,
+		UserEmail: user.Email,
+		IsTyping:  isTyping,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshall TypingSchema")
+	}
+
+	userIDs, err := getChatUsersExcept(db, chatID, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "getChatUsersExcept")
+	}
+
+	// typing is shown only in open chat, so there is no notification
+	return broker.Publish(ctx, ChatEvent{
+		ChatID:  chatID,
+		UserIDs: userIDs,
+		Message: b,
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+)
+
+const minPasswordLength = 8
+
+// bcrypt ignores everything after 72 bytes
+const maxPasswordLength = 72
+
+func newValidator() *validator.Validate {
+	validate := validator.New()
+
+	err := validate.RegisterValidation("password", validatePasswordStrength)
+	if err != nil {
+		panic(err)
+	}
+
+	return validate
+}
+
+// validatePasswordStrength requires password to have allowed length and
+// contain at least one letter and one digit
+func validatePasswordStrength(fl validator.FieldLevel) bool {
+	password := fl.Field().String()
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return false
+	}
+
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+
+	return hasLetter && hasDigit
+}
@@ -1,26 +1,73 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2/log"
+	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
-// userID to websocket connection
-var websocketConnections = map[uint]*websocket.Conn{}
-
 type BaseMessageSchema struct {
 	Type string
+	// RequestID is optional, it is sent back in `error` frame caused by the
+	// frame, so client can tell which frame failed
+	RequestID string `json:",omitempty"`
+}
+
+const (
+	WebsocketErrorInvalidFrame = "invalid_frame"
+	WebsocketErrorUnknownType  = "unknown_type"
+	WebsocketErrorForbidden    = "forbidden"
+	WebsocketErrorNotFound     = "not_found"
+	WebsocketErrorInternal     = "internal_error"
+)
+
+type ErrorFrameSchema struct {
+	BaseMessageSchema
+
+	Code    string
+	Message string
 }
 
-type JoinChatRequestSchema struct {
+// SubscribeRequestSchema is used by `subscribe` and `unsubscribe` frames.
+// Connection gets `new_message` events only for chats it is subscribed to.
+//
+// UserID of frames is optional. Connection is bound to user who opened it, so
+// frames with UserID of another user are rejected
+type SubscribeRequestSchema struct {
 	BaseMessageSchema
 
 	ChatID uint
 	UserID uint
+	// LastMessageID is optional. If it is set, messages of chat after it are
+	// sent as `new_message` frames, followed by `replay_done` frame, before
+	// live messages of chat. It lets client catch up after reconnect
+	LastMessageID *uint `json:",omitempty"`
+	// ChangedSince is optional and used only with LastMessageID. Messages up
+	// to LastMessageID edited or deleted after it are sent as
+	// `message_edited` and `message_deleted` frames before the missed ones.
+	// Client sets it to ReplayedAt of the previous `replay_done` frame
+	ChangedSince *time.Time `json:",omitempty"`
+}
+
+// ReplayDoneSchema ends replay of missed messages. If Truncated is set, there
+// were more missed messages or changes than are replayed, and client should
+// reload messages from message history
+type ReplayDoneSchema struct {
+	BaseMessageSchema
+
+	ChatID uint
+	// LastMessageID is ID of the last replayed message
+	LastMessageID uint
+	Truncated     bool
+	// ReplayedAt is server time replay started at, changes made after it are
+	// sent live
+	ReplayedAt time.Time
 }
 
 type SendMessageRequestSchema struct {
@@ -29,132 +76,599 @@ type SendMessageRequestSchema struct {
 	ChatID  uint
 	UserID  uint
 	Message string
+	// ClientMessageID is optional. Sends with the same ClientMessageID create
+	// only one message, so client can retry them after reconnect
+	ClientMessageID string
+}
+
+// AckSchema is sent back for every `send_message` frame once message is saved
+type AckSchema struct {
+	BaseMessageSchema
+
+	ClientMessageID string `json:",omitempty"`
+	ChatID          uint
+	MessageID       uint
+	CreatedAt       time.Time
+	// IsDeleted is set when retried message was deleted since it was sent
+	IsDeleted bool `json:",omitempty"`
 }
 
 type BroadcastMessageSchema struct {
 	BaseMessageSchema
 
+	ChatID        uint
+	MessageID     uint
+	FromUserID    uint
 	FromUserEmail string
 	Message       string
+	CreatedAt     time.Time
+}
+
+// UnreadNotificationSchema is sent instead of `new_message` to connections of
+// chat members that are not subscribed to the chat
+type UnreadNotificationSchema struct {
+	BaseMessageSchema
+
+	ChatID    uint
+	MessageID uint
 }
 
 func WebsocketHandler(c *websocket.Conn) {
 	db, ok := c.Locals("db").(*gorm.DB)
 	if !ok {
-		log.Fatal("error getting `db` from c.Locals()")
+		log.Error("error getting `db` from c.Locals()")
+		closeWebsocket(c, websocket.CloseInternalServerErr, "internal error")
+		return
+	}
+
+	hub, ok := c.Locals("hub").(*Hub)
+	if !ok {
+		log.Error("error getting `hub` from c.Locals()")
+		closeWebsocket(c, websocket.CloseInternalServerErr, "internal error")
+		return
+	}
+
+	broker, ok := c.Locals("broker").(Broker)
+	if !ok {
+		log.Error("error getting `broker` from c.Locals()")
+		closeWebsocket(c, websocket.CloseInternalServerErr, "internal error")
+		return
+	}
+
+	// `AssertWebSocketUpgradeMiddleware` rejects anonymous handshakes
+	user, ok := c.Locals("currentUser").(*User)
+	if !ok || user == nil {
+		log.Error("error getting `currentUser` from c.Locals()")
+		closeWebsocket(c, websocket.ClosePolicyViolation, (&UnauthorizedUserError{}).Error())
+		return
+	}
+
+	presenceTracker, ok := c.Locals("presence").(*PresenceTracker)
+	if !ok {
+		log.Error("error getting `presence` from c.Locals()")
+		closeWebsocket(c, websocket.CloseInternalServerErr, "internal error")
+		return
+	}
+
+	clientID, err := generateRandomToken()
+	if err != nil {
+		log.Errorf("generate client id err=%s\n", err)
+		closeWebsocket(c, websocket.CloseInternalServerErr, "internal error")
+		return
+	}
+
+	sessionID, _ := c.Locals("sessionID").(string)
+	conn := &websocketClientConn{
+		Conn:        c,
+		idleTimeout: hub.timeouts.IdleTimeout,
+	}
+	client := newClient(clientID, conn, user.ID, sessionID, hub.timeouts)
+	hub.Register(client)
+
+	err = conn.extendReadDeadline()
+	if err != nil {
+		log.Infof("set read deadline err=%s\n", err)
+		hub.Unregister(client)
+		return
 	}
 
+	updatePresence(db, broker, presenceTracker, user, func(ctx context.Context) error {
+		return presenceTracker.Connect(ctx, user.ID, client.id)
+	})
+	lastActivityAt := time.Now()
+
+	c.SetPongHandler(func(string) error {
+		updatePresence(db, broker, presenceTracker, user, func(ctx context.Context) error {
+			return presenceTracker.Heartbeat(ctx, user.ID, client.id)
+		})
+		return conn.extendReadDeadline()
+	})
+
+	writerDone := make(chan struct{})
+	go func() {
+		client.writePump()
+		close(writerDone)
+	}()
+
+	// connection must not be used after handler returns
+	defer func() {
+		hub.Unregister(client)
+		<-writerDone
+		stopAllTyping(db, broker, client, user)
+		updatePresence(db, broker, presenceTracker, user, func(ctx context.Context) error {
+			return presenceTracker.Disconnect(ctx, user.ID, client.id)
+		})
+	}()
+
 	for {
+		// read fails once client is idle for too long or closed, so dead
+		// connections are unregistered
 		messageType, message, err := c.ReadMessage()
 		if err != nil {
 			log.Infof("read error:", err)
 			break
 		}
+
+		err = conn.extendReadDeadline()
+		if err != nil {
+			log.Infof("set read deadline err=%s\n", err)
+			break
+		}
 		log.Infof("recv: %d %+v", messageType, string(message))
 
+		// user is away only after minutes without frames, so activity is
+		// stored once in a while
+		if time.Since(lastActivityAt) > presenceActivityInterval {
+			updatePresence(db, broker, presenceTracker, user, func(ctx context.Context) error {
+				return presenceTracker.Activity(ctx, user.ID)
+			})
+			lastActivityAt = time.Now()
+		}
+
+		if messageType != websocket.TextMessage {
+			client.closeWithMessage(websocket.CloseUnsupportedData, "only text frames are supported")
+			break
+		}
+
 		var v BaseMessageSchema
 		err = json.Unmarshal(message, &v)
 		if err != nil {
-			log.Fatal("json unmarshall WebsocketRequestSchema error: %s\n", err)
+			sendErrorFrame(client, "", &WebsocketError{
+				Code:    WebsocketErrorInvalidFrame,
+				Message: "frame is not a valid JSON object",
+			})
+			continue
+		}
+
+		err = handleFrame(db, hub, broker, client, user, v.Type, message)
+		if err != nil {
+			sendErrorFrame(client, v.RequestID, err)
 		}
+	}
+}
 
-		switch messageType := v.Type; messageType {
-		case "join_chat":
-			handleJoinChat(c, message)
+func handleFrame(db *gorm.DB, hub *Hub, broker Broker, client *Client, user *User, frameType string, message []byte) error {
+	switch frameType {
+	// `join_chat` is kept for clients that have not switched to `subscribe`
+	case "subscribe", "join_chat":
+		return handleSubscribe(db, hub, client, user, message)
 
-		case "send_message":
-			// get users that are in chat and not userID
-			handleSendMessage(db, message)
+	case "unsubscribe":
+		return handleUnsubscribe(hub, client, user, message)
 
-		default:
-			log.Errorf("unhandled message type=%s v=%s\n", messageType, v)
+	case "send_message":
+		return handleSendMessage(db, broker, client, user, message)
+
+	case "mark_read":
+		return handleMarkRead(db, broker, user, message)
+
+	case "typing_start":
+		return handleTyping(db, broker, client, user, message, true)
+
+	case "typing_stop":
+		return handleTyping(db, broker, client, user, message, false)
+
+	default:
+		return &WebsocketError{
+			Code:    WebsocketErrorUnknownType,
+			Message: fmt.Sprintf("unknown frame type %q", frameType),
 		}
 	}
 }
 
-func handleSendMessage(db *gorm.DB, message []byte) {
-	var requestData SendMessageRequestSchema
-	err := json.Unmarshal(message, &requestData)
+// sendErrorFrame sends `error` frame for error caused by frame of client.
+// Details of internal errors are logged and not sent
+func sendErrorFrame(client *Client, requestID string, err error) {
+	errorFrame := ErrorFrameSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type:      "error",
+			RequestID: requestID,
+		},
+	}
+
+	var websocketError *WebsocketError
+	var forbiddenError *ForbiddenError
+	if errors.As(err, &websocketError) {
+		errorFrame.Code = websocketError.Code
+		errorFrame.Message = websocketError.Message
+	} else if errors.As(err, &forbiddenError) {
+		errorFrame.Code = WebsocketErrorForbidden
+		errorFrame.Message = forbiddenError.Error()
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		errorFrame.Code = WebsocketErrorNotFound
+		errorFrame.Message = "not found"
+	} else {
+		log.Errorf("websocket frame error userID=%d err=%s\n", client.userID, err)
+		errorFrame.Code = WebsocketErrorInternal
+		errorFrame.Message = "internal error"
+	}
+
+	b, err := json.Marshal(errorFrame)
 	if err != nil {
-		log.Fatalf("json unmarshall SendMessageRequestSchema error: %s\n", err)
+		log.Errorf("json marshall ErrorFrameSchema err=%s\n", err)
+		return
 	}
-	log.Infof("`send message` message=%+v\n", requestData)
+	client.Send(b)
+}
+
+// websocketClientConn is `clientConn` of websocket connection
+type websocketClientConn struct {
+	*websocket.Conn
+	idleTimeout time.Duration
+}
+
+func (c *websocketClientConn) WriteMessage(message []byte) error {
+	return c.write(websocket.TextMessage, message)
+}
 
-	messageContent := string(requestData.Message)
-	log.Infof("messageContent=%s\n", messageContent)
-	messageObj := Message{
-		ChatID:  requestData.ChatID,
-		FromID:  requestData.UserID,
-		Content: messageContent,
+func (c *websocketClientConn) WritePing() error {
+	return c.write(websocket.PingMessage, nil)
+}
+
+func (c *websocketClientConn) write(messageType int, data []byte) error {
+	err := c.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+	if err != nil {
+		return errors.Wrap(err, "set write deadline")
 	}
-	tx := db.Create(&messageObj)
-	if tx.Error != nil {
-		log.Fatal(tx.Error)
+
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+func (c *websocketClientConn) WriteClose(closeCode int, reason string) error {
+	closeMessage := websocket.FormatCloseMessage(closeCode, reason)
+	return c.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+}
+
+// extendReadDeadline is called on every frame and pong from client. When no
+// frame arrives within idle timeout, read fails and client is unregistered
+func (c *websocketClientConn) extendReadDeadline() error {
+	return c.SetReadDeadline(time.Now().Add(c.idleTimeout))
+}
+
+// closeWebsocket closes connection which has no `Client` yet
+func closeWebsocket(c *websocket.Conn, closeCode int, reason string) {
+	closeMessage := websocket.FormatCloseMessage(closeCode, reason)
+	err := c.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	if err != nil {
+		log.Infof("write close message err=%s\n", err)
 	}
+	c.Close()
+}
 
-	userIDsToSendMessageTo, err := getChatUsersExcept(db, requestData.ChatID, requestData.UserID)
+// unmarshalFrame parses frame into v, or returns `WebsocketError` if frame
+// does not match its schema
+func unmarshalFrame(message []byte, v any) error {
+	err := json.Unmarshal(message, v)
 	if err != nil {
-		log.Fatalf("getChatUsersExcept err=%s\n", err)
+		return &WebsocketError{
+			Code:    WebsocketErrorInvalidFrame,
+			Message: fmt.Sprintf("frame does not match schema: %s", err),
+		}
+	}
+	return nil
+}
+
+// requireFrameUser returns `ForbiddenError` if UserID sent in frame is not
+// empty and belongs to another user than user of connection
+func requireFrameUser(user *User, frameUserID uint) error {
+	if frameUserID != 0 && frameUserID != user.ID {
+		log.Warnf("frame of userID=%d from connection of userID=%d\n", frameUserID, user.ID)
+		return &ForbiddenError{}
 	}
-	log.Infof("will send message to userIDsToSendMessageTo=%+v\n", userIDsToSendMessageTo)
+	return nil
+}
 
-	for _, userID := range userIDsToSendMessageTo {
-		sendMessageToUser(db, userID, messageContent)
+// requireChatMember returns `ForbiddenError` if user is not a member of chat
+func requireChatMember(db *gorm.DB, user *User, chatID uint) error {
+	member, err := getChatMember(db, chatID, user.ID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return &ForbiddenError{}
 	}
+	return nil
 }
 
-func sendMessageToUser(db *gorm.DB, userID uint, messageContent string) {
-	memberConn := websocketConnections[userID]
+const maxClientMessageIDLength = 64
 
-	if memberConn == nil {
-		log.Infof("no connection for userID=%d\n", userID)
-		return
+func handleSendMessage(db *gorm.DB, broker Broker, client *Client, user *User, message []byte) error {
+	var requestData SendMessageRequestSchema
+	err := unmarshalFrame(message, &requestData)
+	if err != nil {
+		return err
+	}
+	log.Infof("`send message` message=%+v\n", requestData)
+
+	if len(requestData.ClientMessageID) > maxClientMessageIDLength {
+		return &WebsocketError{
+			Code:    WebsocketErrorInvalidFrame,
+			Message: fmt.Sprintf("ClientMessageID must be at most %d characters", maxClientMessageIDLength),
+		}
+	}
+
+	err = requireFrameUser(user, requestData.UserID)
+	if err != nil {
+		return err
 	}
 
-	twentySecondFromNow := time.Now().Add(time.Second * 10)
-	err := memberConn.WriteControl(websocket.PingMessage, []byte("hello from the other side"), twentySecondFromNow)
+	err = requireChatMember(db, user, requestData.ChatID)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	var fromUser User
-	err = db.Find(&fromUser, userID).Error
+	savedMessage, isCreated, err := saveMessage(db, user.ID, requestData.ChatID, requestData.Message, requestData.ClientMessageID)
 	if err != nil {
-		log.Fatalf("get user by id failed id=%d\n", userID)
+		return err
 	}
 
-	broadcastMessageData := BroadcastMessageSchema{
+	// retried message was published already
+	if isCreated {
+		err = publishNewMessage(context.Background(), db, broker, user, savedMessage, client.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(AckSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type:      "ack",
+			RequestID: requestData.RequestID,
+		},
+		ClientMessageID: requestData.ClientMessageID,
+		ChatID:          savedMessage.ChatID,
+		MessageID:       savedMessage.ID,
+		CreatedAt:       savedMessage.CreatedAt,
+		IsDeleted:       savedMessage.DeletedAt.Valid,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshall AckSchema")
+	}
+	client.Send(b)
+
+	return nil
+}
+
+func newBroadcastMessage(fromUser *User, message *Message) ([]byte, error) {
+	b, err := json.Marshal(BroadcastMessageSchema{
 		BaseMessageSchema: BaseMessageSchema{
 			Type: "new_message",
 		},
+		ChatID:        message.ChatID,
+		MessageID:     message.ID,
+		FromUserID:    fromUser.ID,
 		FromUserEmail: fromUser.Email,
-		Message:       messageContent,
+		Message:       message.Content,
+		CreatedAt:     message.CreatedAt,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshall BroadcastMessageSchema")
+	}
+	return b, nil
+}
+
+// publishNewMessage sends message to members of its chat. Connections
+// subscribed to the chat get the message and connections of other members
+// get unread notification instead. Connection with skipClientID sent the
+// message and gets `ack` instead, it is empty for messages sent by API
+func publishNewMessage(ctx context.Context, db *gorm.DB, broker Broker, fromUser *User, message *Message, skipClientID string) error {
+	b, err := newBroadcastMessage(fromUser, message)
+	if err != nil {
+		return err
+	}
+
+	unreadNotificationData := UnreadNotificationSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type: "unread",
+		},
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+	}
+	notification, err := json.Marshal(unreadNotificationData)
+	if err != nil {
+		return errors.Wrap(err, "json marshall UnreadNotificationSchema")
+	}
+
+	userIDs, err := getChatUsersExcept(db, message.ChatID, fromUser.ID)
+	if err != nil {
+		return errors.Wrap(err, "getChatUsersExcept")
+	}
+	log.Infof("will send message to userIDs=%+v\n", userIDs)
+
+	err = broker.Publish(ctx, ChatEvent{
+		ChatID:       message.ChatID,
+		MessageID:    message.ID,
+		UserIDs:      userIDs,
+		Message:      b,
+		Notification: notification,
+	})
+	if err != nil {
+		return err
+	}
+
+	// other connections of sender show the message too, but it is not unread
+	// for sender
+	return broker.Publish(ctx, ChatEvent{
+		ChatID:       message.ChatID,
+		MessageID:    message.ID,
+		UserIDs:      []uint{fromUser.ID},
+		Message:      b,
+		SkipClientID: skipClientID,
+	})
+}
+
+func handleSubscribe(db *gorm.DB, hub *Hub, client *Client, user *User, message []byte) error {
+	var requestData SubscribeRequestSchema
+	err := unmarshalFrame(message, &requestData)
+	if err != nil {
+		return err
 	}
-	b, err := json.Marshal(broadcastMessageData)
+	log.Infof("`subscribe` message=%+v\n", requestData)
+
+	err = requireFrameUser(user, requestData.UserID)
 	if err != nil {
-		log.Fatalf("json marshall err:%s\n", err)
+		return err
 	}
 
-	err = memberConn.WriteMessage(websocket.TextMessage, b)
+	err = requireChatMember(db, user, requestData.ChatID)
 	if err != nil {
-		log.Fatalf("error WriteMessage %s\n", err)
+		return err
+	}
+
+	if requestData.LastMessageID == nil {
+		hub.Subscribe(client, requestData.ChatID)
+		// TODO: broadcast to other users in chat, than a new user has joined
+		return nil
 	}
+
+	// live messages are held from now on, so the ones saved while missed
+	// messages are loaded are not lost
+	hub.StartReplay(client, requestData.ChatID)
+	lastReplayedMessageID, err := replayMessages(db, client, requestData)
+	hub.FinishReplay(client, requestData.ChatID, lastReplayedMessageID)
+	return err
 }
 
-func handleJoinChat(c *websocket.Conn, message []byte) {
-	var requestData JoinChatRequestSchema
-	err := json.Unmarshal(message, &requestData)
+// Replay is loaded in pages and at most `maxReplayMessages` are replayed, the
+// rest is left for message history. It also bounds live messages held during
+// replay
+const replayPageSize = 100
+const maxReplayMessages = 1000
+
+// replayMessages sends changes of messages client has seen if ChangedSince of
+// request is set, messages of chat after LastMessageID of request and
+// `replay_done` frame. Deleted messages are skipped. It returns ID of the last
+// replayed message
+func replayMessages(db *gorm.DB, client *Client, requestData SubscribeRequestSchema) (uint, error) {
+	replayedAt := time.Now()
+	lastMessageID := *requestData.LastMessageID
+	replayedCount := 0
+	isTruncated := false
+
+	if requestData.ChangedSince != nil {
+		var err error
+		isTruncated, err = replayMessageChanges(db, client, requestData.ChatID, lastMessageID, *requestData.ChangedSince)
+		if err != nil {
+			return lastMessageID, err
+		}
+	}
+
+	// client reloads messages anyway if there are too many changes
+	for !isTruncated {
+		limit := min(replayPageSize, maxReplayMessages-replayedCount)
+		messages, hasMore, err := getMessagesAfter(db, requestData.ChatID, lastMessageID, limit)
+		if err != nil {
+			return lastMessageID, errors.Wrap(err, "getMessagesAfter")
+		}
+
+		for i := range messages {
+			// client has not seen deleted message, so there is nothing to show
+			if messages[i].DeletedAt.Valid {
+				lastMessageID = messages[i].ID
+				continue
+			}
+
+			b, err := newBroadcastMessage(&messages[i].From, &messages[i])
+			if err != nil {
+				return lastMessageID, err
+			}
+
+			// replay can be larger than send queue, so it waits for writer
+			err = client.SendWait(b)
+			if err != nil {
+				return lastMessageID, err
+			}
+			lastMessageID = messages[i].ID
+		}
+		replayedCount += len(messages)
+
+		if !hasMore {
+			break
+		}
+		if replayedCount >= maxReplayMessages {
+			isTruncated = true
+			break
+		}
+	}
+
+	b, err := json.Marshal(ReplayDoneSchema{
+		BaseMessageSchema: BaseMessageSchema{
+			Type:      "replay_done",
+			RequestID: requestData.RequestID,
+		},
+		ChatID:        requestData.ChatID,
+		LastMessageID: lastMessageID,
+		Truncated:     isTruncated,
+		ReplayedAt:    replayedAt,
+	})
+	if err != nil {
+		return lastMessageID, errors.Wrap(err, "json marshall ReplayDoneSchema")
+	}
+
+	return lastMessageID, client.SendWait(b)
+}
+
+// replayMessageChanges sends edits and deletes of messages of chat up to
+// untilID made after since. It returns true if there were more changes than
+// are replayed
+func replayMessageChanges(db *gorm.DB, client *Client, chatID uint, untilID uint, since time.Time) (bool, error) {
+	messages, hasMore, err := getMessagesChangedSince(db, chatID, untilID, since, maxReplayMessages)
 	if err != nil {
-		log.Fatalf("json unmarshall JoinChatRequestSchema error: %s\n", err)
+		return false, errors.Wrap(err, "getMessagesChangedSince")
 	}
-	log.Infof("`join chat` message=%+v\n", requestData)
 
-	userID := requestData.UserID
-	_, exists := websocketConnections[userID]
-	if exists {
-		websocketConnections[userID].Close()
+	for i := range messages {
+		var b []byte
+		if messages[i].DeletedAt.Valid {
+			b, err = newMessageDeletedFrame(&messages[i])
+		} else {
+			b, err = newMessageEditedFrame(&messages[i])
+		}
+		if err != nil {
+			return false, err
+		}
+
+		err = client.SendWait(b)
+		if err != nil {
+			return false, err
+		}
+	}
+	return hasMore, nil
+}
+
+func handleUnsubscribe(hub *Hub, client *Client, user *User, message []byte) error {
+	var requestData SubscribeRequestSchema
+	err := unmarshalFrame(message, &requestData)
+	if err != nil {
+		return err
+	}
+	log.Infof("`unsubscribe` message=%+v\n", requestData)
+
+	err = requireFrameUser(user, requestData.UserID)
+	if err != nil {
+		return err
 	}
-	websocketConnections[userID] = c
 
-	// TODO: broadcast to other users in chat, than a new user has joined
+	hub.Unsubscribe(client, requestData.ChatID)
+	return nil
 }